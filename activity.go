@@ -0,0 +1,76 @@
+package sqlds
+
+import (
+	"sync"
+	"time"
+)
+
+// activity counts a datastore's open batches and streaming queries, so that
+// Close can wait for them, and tells the streams to stop once it gives up.
+type activity struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newActivity() *activity {
+	return &activity{stopped: make(chan struct{})}
+}
+
+func (a *activity) begin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.n++
+}
+
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.n--
+	if a.n == 0 && a.idle != nil {
+		close(a.idle)
+		a.idle = nil
+	}
+}
+
+// wait waits up to timeout for every batch and stream to finish, reporting
+// whether they did.
+func (a *activity) wait(timeout time.Duration) bool {
+	a.mu.Lock()
+	if a.n == 0 {
+		a.mu.Unlock()
+		return true
+	}
+	if a.idle == nil {
+		a.idle = make(chan struct{})
+	}
+	idle := a.idle
+	a.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// stop tells the streams still running to stop.
+func (a *activity) stop() {
+	a.stopOnce.Do(func() { close(a.stopped) })
+}
+
+// isStopped reports whether stop was called, without blocking.
+func (a *activity) isStopped() bool {
+	select {
+	case <-a.stopped:
+		return true
+	default:
+		return false
+	}
+}
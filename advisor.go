@@ -0,0 +1,85 @@
+package sqlds
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// maxAdvisorPrefixes bounds the distinct prefixes the index advisor keeps.
+// Once reached, prefixes not yet seen are no longer recorded.
+const maxAdvisorPrefixes = 1000
+
+// IndexQueries is implemented by Queries for databases that can index keys
+// for prefix matching.
+type IndexQueries interface {
+	// PatternIndex returns the statement creating an index that serves
+	// LIKE prefix matches on keys whatever the key collation.
+	PatternIndex() string
+}
+
+// indexAdvisor counts the distinct prefixes queried.
+type indexAdvisor struct {
+	mu       sync.Mutex
+	prefixes map[string]int64
+}
+
+func newIndexAdvisor() *indexAdvisor {
+	return &indexAdvisor{prefixes: make(map[string]int64)}
+}
+
+func (a *indexAdvisor) observe(prefix string) {
+	if a == nil || prefix == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.prefixes[prefix]; ok || len(a.prefixes) < maxAdvisorPrefixes {
+		a.prefixes[prefix]++
+	}
+}
+
+// observed returns the recorded prefixes, most queried first.
+func (a *indexAdvisor) observed() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	prefixes := make([]string, 0, len(a.prefixes))
+	for p := range a.prefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		ci, cj := a.prefixes[prefixes[i]], a.prefixes[prefixes[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	return prefixes
+}
+
+// SuggestIndexes returns CREATE INDEX statements that would speed up the
+// prefix queries seen since the datastore was opened with IndexAdvisor
+// enabled. It checks the plan of each distinct prefix seen, and suggests a
+// pattern-matching index on keys if any would scan the whole table. Nothing
+// is created; run the statements, which build the index without blocking
+// writes, if the suggestion suits the workload. As with VerifyIndexUsage,
+// plans depend on the table's statistics.
+func (d *Datastore) SuggestIndexes(ctx context.Context) ([]string, error) {
+	iq, ok := d.queries.(IndexQueries)
+	if d.advisor == nil || !ok {
+		return nil, ErrUnsupported
+	}
+
+	for _, prefix := range d.advisor.observed() {
+		used, err := d.VerifyIndexUsage(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			return []string{iq.PatternIndex()}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,274 @@
+//go:build bench
+// +build bench
+
+package sqlds
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// The benchmarks run against the postgres described by the SQLDS_BENCH_*
+// environment variables, defaulting to a local server:
+//
+//	go test -tags bench -run '^$' -bench . -benchtime 10000x
+var (
+	benchValueSizes  = []int{64, 4096, 65536}
+	benchConcurrency = []int{1, 8, 32}
+)
+
+func benchStore(b *testing.B, table string) (*Datastore, func()) {
+	return benchStoreWith(b, &Options{Table: table})
+}
+
+// benchStoreWith is like benchStore, taking the options other than the
+// connection's.
+func benchStoreWith(b *testing.B, opts *Options) (*Datastore, func()) {
+	opts.Host = envOr("SQLDS_BENCH_HOST", "127.0.0.1")
+	opts.Port = envOr("SQLDS_BENCH_PORT", "5432")
+	opts.User = envOr("SQLDS_BENCH_USER", "postgres")
+	opts.Password = os.Getenv("SQLDS_BENCH_PASSWORD")
+	opts.Database = envOr("SQLDS_BENCH_DATABASE", "test_datastore")
+	d, err := opts.CreatePostgres()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return d, func() {
+		d.db.Exec("DROP TABLE IF EXISTS " + opts.quotedTable())
+		d.Close()
+	}
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// workload generates the keys and values a benchmark operates on.
+type workload struct {
+	// keys is the size of the key space operations are spread over.
+	keys      int
+	valueSize int
+}
+
+func (w workload) key(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%02d/%08d", i%100, i%w.keys))
+}
+
+func (w workload) value() []byte {
+	v := make([]byte, w.valueSize)
+	rand.Read(v)
+	return v
+}
+
+// fill writes every key of the workload.
+func (w workload) fill(b *testing.B, d *Datastore) {
+	batch, err := d.Batch()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < w.keys; i++ {
+		if err := batch.Put(w.key(i), w.value()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// latencies collects operation durations across goroutines.
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.d = append(l.d, d)
+	l.mu.Unlock()
+}
+
+func (l *latencies) percentile(p float64) time.Duration {
+	if len(l.d) == 0 {
+		return 0
+	}
+	sort.Slice(l.d, func(i, j int) bool { return l.d[i] < l.d[j] })
+	return l.d[int(p*float64(len(l.d)-1))]
+}
+
+// drive runs b.N calls of op spread over concurrency goroutines, passing
+// each call its index, and reports throughput and latency percentiles.
+func drive(b *testing.B, concurrency int, op func(i int) error) {
+	var next int64 = -1
+	var lat latencies
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	start := time.Now()
+	for g := 0; g < concurrency; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= b.N {
+					return
+				}
+				t := time.Now()
+				if err := op(i); err != nil {
+					b.Error(err)
+					return
+				}
+				lat.add(time.Since(t))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "ops/s")
+	b.ReportMetric(float64(lat.percentile(0.50).Microseconds()), "p50-µs")
+	b.ReportMetric(float64(lat.percentile(0.99).Microseconds()), "p99-µs")
+}
+
+// matrix runs bench for every combination of value size and concurrency.
+func matrix(b *testing.B, bench func(b *testing.B, w workload, concurrency int)) {
+	for _, size := range benchValueSizes {
+		for _, c := range benchConcurrency {
+			w := workload{keys: 1000, valueSize: size}
+			b.Run(fmt.Sprintf("size=%d/conc=%d", size, c), func(b *testing.B) {
+				bench(b, w, c)
+			})
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	matrix(b, func(b *testing.B, w workload, c int) {
+		d, done := benchStore(b, "benchget")
+		defer done()
+		w.fill(b, d)
+		drive(b, c, func(i int) error {
+			_, err := d.Get(w.key(i))
+			return err
+		})
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	matrix(b, func(b *testing.B, w workload, c int) {
+		d, done := benchStore(b, "benchput")
+		defer done()
+		value := w.value()
+		drive(b, c, func(i int) error {
+			return d.Put(w.key(i), value)
+		})
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	matrix(b, func(b *testing.B, w workload, c int) {
+		d, done := benchStore(b, "benchquery")
+		defer done()
+		w.fill(b, d)
+		drive(b, c, func(i int) error {
+			rs, err := d.Query(dsq.Query{Prefix: fmt.Sprintf("/bench/%02d", i%100)})
+			if err != nil {
+				return err
+			}
+			_, err = rs.Rest()
+			return err
+		})
+	})
+}
+
+func BenchmarkBatch(b *testing.B) {
+	const batchSize = 100
+	matrix(b, func(b *testing.B, w workload, c int) {
+		d, done := benchStore(b, "benchbatch")
+		defer done()
+		value := w.value()
+		drive(b, c, func(i int) error {
+			batch, err := d.Batch()
+			if err != nil {
+				return err
+			}
+			for j := 0; j < batchSize; j++ {
+				if err := batch.Put(w.key(i*batchSize+j), value); err != nil {
+					return err
+				}
+			}
+			return batch.Commit()
+		})
+	})
+}
+
+// BenchmarkPrepared compares the single-key operations with and without
+// PrepareStatements, cycling through Get, Has, GetSize and Put.
+func BenchmarkPrepared(b *testing.B) {
+	for _, prepared := range []bool{false, true} {
+		for _, c := range benchConcurrency {
+			w := workload{keys: 1000, valueSize: 64}
+			b.Run(fmt.Sprintf("prepared=%t/conc=%d", prepared, c), func(b *testing.B) {
+				d, done := benchStoreWith(b, &Options{Table: "benchprepared", PrepareStatements: prepared})
+				defer done()
+				w.fill(b, d)
+				value := w.value()
+				drive(b, c, func(i int) error {
+					var err error
+					switch i % 4 {
+					case 0:
+						_, err = d.Get(w.key(i))
+					case 1:
+						_, err = d.Has(w.key(i))
+					case 2:
+						_, err = d.GetSize(w.key(i))
+					default:
+						err = d.Put(w.key(i), value)
+					}
+					return err
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkMixed runs a read-heavy mix of 80% gets, 15% puts and 5% prefix
+// queries.
+func BenchmarkMixed(b *testing.B) {
+	matrix(b, func(b *testing.B, w workload, c int) {
+		d, done := benchStore(b, "benchmixed")
+		defer done()
+		w.fill(b, d)
+		value := w.value()
+		drive(b, c, func(i int) error {
+			switch n := i % 100; {
+			case n < 80:
+				_, err := d.Get(w.key(i))
+				return err
+			case n < 95:
+				return d.Put(w.key(i), value)
+			default:
+				rs, err := d.Query(dsq.Query{Prefix: fmt.Sprintf("/bench/%02d", i%100)})
+				if err != nil {
+					return err
+				}
+				_, err = rs.Rest()
+				return err
+			}
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrCircuitOpen is returned without contacting the database while the
+// circuit breaker is open after repeated failures.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker fast-fails operations after threshold consecutive database
+// failures. Once cooldown has passed since it opened, a single probe is let
+// through: success closes the breaker, failure re-opens it for another
+// cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen if the operation should not reach the
+// database, and otherwise whether it is the half-open breaker's probe, to
+// be passed on to record. A nil breaker allows everything.
+func (b *circuitBreaker) allow() (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// record reports the outcome of an operation allowed through, and whether
+// it was the probe. Errors that mean the database answered, such as a
+// missing row or a statement it rejected, count as successes, and
+// operations cancelled by their caller count as neither. Only failures to
+// reach the database, such as connection errors and timeouts, count toward
+// opening the breaker.
+func (b *circuitBreaker) record(probe bool, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil || errors.Is(err, sql.ErrNoRows) || errors.Is(err, ds.ErrNotFound) || isRejection(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
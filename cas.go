@@ -0,0 +1,70 @@
+package sqlds
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SwapQueries is implemented by Queries that can replace a value only if
+// it is still the one the caller expects.
+type SwapQueries interface {
+	// CompareAndSwap sets the value of the key given as the first argument
+	// to the third if it is still the second. It returns an empty string
+	// when the table's layout doesn't allow updating a value in place.
+	CompareAndSwap() string
+	// CompareAndSwapHash is like CompareAndSwap, comparing the SHA-256 of
+	// the value with the second argument instead. It returns an empty
+	// string when the table has no checksums.
+	CompareAndSwapHash() string
+}
+
+// CompareAndSwap sets the value of key to new if it is still old, and
+// reports whether it did. It reports false without error if key is
+// missing. The whole of old is compared in the database; see
+// CompareAndSwapHash for large values.
+func (d *Datastore) CompareAndSwap(ctx context.Context, key ds.Key, old, new []byte) (bool, error) {
+	sq, ok := d.queries.(SwapQueries)
+	if !ok || sq.CompareAndSwap() == "" {
+		return false, ErrUnsupported
+	}
+	return d.swap(ctx, sq.CompareAndSwap(), key, old, new)
+}
+
+// CompareAndSwapHash is like CompareAndSwap, comparing the stored checksum
+// of the value with oldHash, the SHA-256 of the expected value, so that
+// only the hash is sent and compared rather than the whole value. It
+// requires the table to have been created with checksums enabled.
+func (d *Datastore) CompareAndSwapHash(ctx context.Context, key ds.Key, oldHash, new []byte) (bool, error) {
+	sq, ok := d.queries.(SwapQueries)
+	if !ok || sq.CompareAndSwapHash() == "" {
+		return false, ErrUnsupported
+	}
+	return d.swap(ctx, sq.CompareAndSwapHash(), key, oldHash, new)
+}
+
+func (d *Datastore) swap(ctx context.Context, stmt string, key ds.Key, expected, new []byte) (bool, error) {
+	if new == nil {
+		return false, ErrInvalidType
+	}
+	if err := d.validateKey(key); err != nil {
+		return false, err
+	}
+	// A held put must be compared against, not land after the swap.
+	if c := d.coalesce; c != nil {
+		if err := c.flush(); err != nil {
+			return false, err
+		}
+	}
+
+	waits := d.db.Stats().WaitCount
+	result, err := d.db.ExecContext(ctx, stmt, key.String(), expected, new)
+	if err != nil {
+		return false, keyError("swap", key.String(), d.poolError(ctxError(ctx, err), waits))
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, keyError("swap", key.String(), err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,177 @@
+package sqlds
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// coalescer holds the last value put to each key for up to a window before
+// writing it, so that repeated puts to the same key make a single write.
+type coalescer struct {
+	window time.Duration
+	write  func(key string, value []byte) error
+	logf   func(format string, args ...interface{})
+
+	// writing is held while held values are written, and by operations
+	// that must not be overtaken by a held put landing after them.
+	writing sync.Mutex
+
+	mu        sync.Mutex
+	pending   map[string][]byte
+	scheduled bool
+	closed    bool
+}
+
+func newCoalescer(window time.Duration, write func(key string, value []byte) error, logf func(format string, args ...interface{})) *coalescer {
+	return &coalescer{window: window, write: write, logf: logf, pending: make(map[string][]byte)}
+}
+
+// put holds value as the latest for key, scheduling a flush, and reports
+// whether it did: once closed, the caller must write value itself.
+func (c *coalescer) put(key string, value []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.pending[key] = value
+	c.schedule()
+	return true
+}
+
+// get returns the value held for key, if any.
+func (c *coalescer) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.pending[key]
+	return v, ok
+}
+
+// drop discards the value held for key, reporting whether there was one.
+func (c *coalescer) drop(key string) bool {
+	_, ok := c.take(key)
+	return ok
+}
+
+// take removes and returns the value held for key, if any.
+func (c *coalescer) take(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.pending[key]
+	delete(c.pending, key)
+	return v, ok
+}
+
+// hold holds values again, unless since replaced, scheduling a flush.
+func (c *coalescer) hold(values map[string][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range values {
+		if _, ok := c.pending[k]; !ok {
+			c.pending[k] = v
+		}
+	}
+	c.schedule()
+}
+
+// schedule starts the timer flushing held values, unless already running.
+// c.mu must be held.
+func (c *coalescer) schedule() {
+	if c.scheduled || c.closed {
+		return
+	}
+	c.scheduled = true
+	time.AfterFunc(c.window, func() {
+		c.mu.Lock()
+		c.scheduled = false
+		c.mu.Unlock()
+		// Rejected values were logged as they were dropped; the others are
+		// retried after another window.
+		if err := c.flush(); err != nil && !isRejection(err) {
+			c.logf("sqlds: writing held puts: %v", err)
+		}
+	})
+}
+
+// close flushes the held values one last time, without retrying them.
+func (c *coalescer) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.flush()
+}
+
+// flush writes the held values. A value the database rejects is logged and
+// dropped, as retrying it would fail again, and the first such error is
+// returned once the others are written. Should a write fail otherwise, the
+// values not yet written are held again, unless since replaced, and retried
+// after another window.
+func (c *coalescer) flush() error {
+	return c.flushWhere(nil)
+}
+
+// flushPrefix writes the held values of the keys under prefix, like flush,
+// so that a value failing to write doesn't fail reads of other keys.
+func (c *coalescer) flushPrefix(prefix string) error {
+	prefix = ds.NewKey(prefix).String()
+	return c.flushWhere(func(key string) bool { return strings.HasPrefix(key, prefix) })
+}
+
+// flushKeys writes the held values of keys, like flush.
+func (c *coalescer) flushKeys(keys []string) error {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return c.flushWhere(func(key string) bool { return set[key] })
+}
+
+// flushWhere writes the held values of the keys matching match, or of every
+// key if nil.
+func (c *coalescer) flushWhere(match func(key string) bool) error {
+	if c == nil {
+		return nil
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+
+	c.mu.Lock()
+	pending := c.pending
+	if match == nil {
+		c.pending = make(map[string][]byte)
+	} else {
+		pending = make(map[string][]byte)
+		for k, v := range c.pending {
+			if match(k) {
+				pending[k] = v
+				delete(c.pending, k)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	var rejected error
+	for key, value := range pending {
+		if err := c.write(key, value); err != nil {
+			if !isRejection(err) {
+				c.hold(pending)
+				return err
+			}
+			c.logf("sqlds: dropping held put: %v", err)
+			if rejected == nil {
+				rejected = err
+			}
+		}
+		delete(pending, key)
+	}
+	return rejected
+}
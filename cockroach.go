@@ -0,0 +1,208 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+)
+
+// defaultCockroachRetries is how many times CreateCockroach's batches replay
+// their transaction after a serialization failure by default.
+const defaultCockroachRetries = 5
+
+// cockroachQueries are the Queries for a CockroachDB table. CockroachDB
+// speaks the postgres protocol, but writes with UPSERT and manages storage
+// itself, so it has no statements for Compact, Reindex or CollectGarbage,
+// which return ErrUnsupported.
+type cockroachQueries struct {
+	tableName string
+}
+
+// NewCockroachQueriesForTable returns the Queries for a CockroachDB table.
+func NewCockroachQueriesForTable(tableName string) Queries {
+	return cockroachQueries{tableName: tableName}
+}
+
+func (q cockroachQueries) Delete() string {
+	return `DELETE FROM ` + q.table() + ` WHERE key = $1`
+}
+
+func (q cockroachQueries) Exists() string {
+	return `SELECT EXISTS(SELECT 1 FROM ` + q.table() + ` WHERE key = $1)`
+}
+
+func (q cockroachQueries) Get() string {
+	return `SELECT data FROM ` + q.table() + ` WHERE key = $1`
+}
+
+func (q cockroachQueries) Put() string {
+	return `UPSERT INTO ` + q.table() + ` (key, data) VALUES ($1, $2)`
+}
+
+func (q cockroachQueries) Query() string {
+	return `SELECT key, data FROM ` + q.table()
+}
+
+func (q cockroachQueries) QueryKeysOnly() string {
+	return `SELECT key FROM ` + q.table()
+}
+
+func (q cockroachQueries) QuerySizes() string {
+	return `SELECT key, length(data) FROM ` + q.table()
+}
+
+func (q cockroachQueries) TotalSize() string {
+	return `SELECT COALESCE(SUM(length(data)), 0) FROM ` + q.table()
+}
+
+func (q cockroachQueries) Empty() string {
+	return `SELECT NOT EXISTS (SELECT 1 FROM ` + q.table() + `)`
+}
+
+func (q cockroachQueries) Prefix() string {
+	return ` WHERE key LIKE $1 ESCAPE '\' ORDER BY key`
+}
+
+func (q cockroachQueries) PrefixDescending() string {
+	return ` WHERE key LIKE $1 ESCAPE '\' ORDER BY key DESC`
+}
+
+func (q cockroachQueries) OrderByKey() string {
+	return ` ORDER BY key`
+}
+
+func (q cockroachQueries) OrderByKeyDescending() string {
+	return ` ORDER BY key DESC`
+}
+
+func (q cockroachQueries) PrefixByKeyLength() string {
+	return ` WHERE key LIKE $1 ESCAPE '\' ORDER BY char_length(key), key`
+}
+
+func (q cockroachQueries) OrderByKeyLength() string {
+	return ` ORDER BY char_length(key), key`
+}
+
+func (q cockroachQueries) Limit() string {
+	return ` LIMIT %d`
+}
+
+func (q cockroachQueries) Offset() string {
+	return ` OFFSET %d`
+}
+
+func (q cockroachQueries) GetSize() string {
+	return `SELECT length(data) FROM ` + q.table() + ` WHERE key = $1`
+}
+
+func (q cockroachQueries) ExistingKeys() string {
+	return `SELECT key FROM ` + q.table() + ` WHERE key = ANY($1::STRING[])`
+}
+
+func (q cockroachQueries) Compact() string {
+	return ""
+}
+
+func (q cockroachQueries) Reindex() string {
+	return ""
+}
+
+func (q cockroachQueries) Vacuum() string {
+	return ""
+}
+
+func (q cockroachQueries) Analyze() string {
+	return `ANALYZE ` + q.table()
+}
+
+func (q cockroachQueries) DeletePrefix() string {
+	return `DELETE FROM ` + q.table() + ` WHERE key LIKE $1 ESCAPE '\'`
+}
+
+func (q cockroachQueries) DeleteMany() string {
+	return `DELETE FROM ` + q.table() + ` WHERE key = ANY($1::STRING[])`
+}
+
+func (q cockroachQueries) SizesMany() string {
+	return `SELECT key, length(data) FROM ` + q.table() + ` WHERE key = ANY($1::STRING[])`
+}
+
+func (q cockroachQueries) GetMany() string {
+	return `SELECT key, data FROM ` + q.table() + ` WHERE key = ANY($1::STRING[])`
+}
+
+func (q cockroachQueries) LikeEscape() rune {
+	return '\\'
+}
+
+// QuoteIdent quotes a single identifier, which CockroachDB does like
+// postgres.
+func (q cockroachQueries) QuoteIdent(name string) string {
+	return pgQuoteIdent(name)
+}
+
+func (q cockroachQueries) table() string {
+	return quoteQualified(q.QuoteIdent, q.tableName)
+}
+
+// cockroachCreateTableSQL returns the statement creating the table. STRING
+// compares bytewise, so keys sort like keys in postgres under the C
+// collation.
+func (opts *Options) cockroachCreateTableSQL() string {
+	table := cockroachQueries{tableName: opts.Table}.table()
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (key STRING NOT NULL PRIMARY KEY, data BYTES NOT NULL)`
+}
+
+// CreateCockroach returns a datastore connected to CockroachDB, creating its
+// table if needed. Port and user default to 26257 and root, and
+// SerializationRetries to 5, since CockroachDB runs every transaction at
+// SERIALIZABLE isolation and expects clients to retry the ones it aborts.
+// The options shaping postgres SQL return ErrUnsupported if set.
+func (opts *Options) CreateCockroach() (*Datastore, error) {
+	return opts.CreateCockroachContext(context.Background())
+}
+
+// CreateCockroachContext is like CreateCockroach, giving up when ctx is done.
+func (opts *Options) CreateCockroachContext(ctx context.Context) (*Datastore, error) {
+	if err := opts.checkPortable("CockroachDB"); err != nil {
+		return nil, err
+	}
+
+	if opts.Port == "" {
+		opts.Port = "26257"
+	}
+	if opts.User == "" {
+		opts.User = "root"
+	}
+	if opts.SerializationRetries == 0 {
+		opts.SerializationRetries = defaultCockroachRetries
+	}
+	opts.setDefaults()
+
+	dsn := opts.ConnectionString
+	if dsn == "" {
+		dsn = opts.dsn(opts.Host, opts.Port)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	opts.configurePool(db)
+
+	if err := pingContext(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, opts.cockroachCreateTableSQL()); err != nil {
+		db.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	d := NewDatastore(db, cockroachQueries{tableName: opts.Table})
+	opts.configure(d)
+	d.connInfo = opts.postgresConnInfo()
+	return d, nil
+}
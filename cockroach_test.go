@@ -0,0 +1,65 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+)
+
+func TestCockroachBatchRetry(t *testing.T) {
+	q := cockroachQueries{tableName: "kv"}
+	failed := false
+	m := &mockDB{handle: func(query string, args []driver.Value) (mockResponse, error) {
+		if query != q.Put() {
+			return mockResponse{}, errors.New("unexpected statement: " + query)
+		}
+		// The first write of /b aborts the transaction, as CockroachDB
+		// does when it conflicts with a concurrent one.
+		if args[0] == "/b" && !failed {
+			failed = true
+			return mockResponse{}, &pq.Error{Code: "40001"}
+		}
+		return mockResponse{affected: 1}, nil
+	}}
+	d := NewDatastore(m.open(), NewCockroachQueriesForTable("kv"))
+	defer d.Close()
+	(&Options{SerializationRetries: 2}).configure(d)
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/b"), []byte("2")); err != nil {
+		t.Fatalf("expected the batch to be retried, got %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	put := q.Put()
+	want := []string{put, put, "ROLLBACK", put, put, "COMMIT"}
+	if got := m.statements(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected statements:\n got: %q\nwant: %q", got, want)
+	}
+
+	// CockroachDB manages its storage itself.
+	if err := d.Compact(context.Background()); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported from Compact, got %v", err)
+	}
+}
+
+func TestCreateCockroachRejectsPostgresOptions(t *testing.T) {
+	for _, opts := range []Options{{Seq: true}, {TextValues: true}, {KeyColumn: "k"}} {
+		if _, err := opts.CreateCockroach(); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%+v: expected ErrUnsupported, got %v", opts, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package sqlds
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// ErrConflict is returned by batch operations and Commit when a write
+// violates a constraint, naming the key that caused it. Key is empty when
+// postgres didn't report it, as for constraints on columns other than key.
+type ErrConflict struct {
+	Key        string
+	Constraint string
+	Err        error
+}
+
+func (e *ErrConflict) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("constraint %s violated: %s", e.Constraint, e.Err)
+	}
+	return fmt.Sprintf("constraint %s violated by key %s: %s", e.Constraint, e.Key, e.Err)
+}
+
+func (e *ErrConflict) Unwrap() error {
+	return e.Err
+}
+
+// conflictDetailKey matches the detail of violations on the default key
+// column, for datastores not made from Options.
+var conflictDetailKey = conflictPattern("key")
+
+// conflictPattern returns the pattern matching the detail postgres gives
+// unique, foreign key and exclusion violations on the column, capturing the
+// key. Postgres quotes the column there if it is a reserved word.
+func conflictPattern(column string) *regexp.Regexp {
+	name := regexp.QuoteMeta(column)
+	return regexp.MustCompile(`^Key \((?:` + name + `|"` + name + `")\)=\((.*?)\) (?:already exists|is not present|conflicts with)`)
+}
+
+// isSerializationFailure reports whether err is a serialization failure,
+// which aborts a transaction that would be safe to run again.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
+// isRejection reports whether err is the database refusing a statement, as
+// for invalid input or a violated constraint, rather than a failure to reach
+// it in time, which running the statement again may get past.
+func isRejection(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57", "58": // connection, rollback, resources, operator, system
+			return false
+		}
+		return true
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1040, 1205, 1213, 3024: // too many connections, lock wait timeout, deadlock, query timeout
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// conflictError returns err as an ErrConflict if it is an integrity
+// constraint violation. The key named in the error's detail, as matched by
+// detail or conflictDetailKey if nil, takes precedence over key, the one
+// being written, since a violation of a deferred constraint is reported for
+// whichever row caused it.
+func conflictError(err error, key string, detail *regexp.Regexp) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code.Class() != "23" {
+		return err
+	}
+	if detail == nil {
+		detail = conflictDetailKey
+	}
+	if m := detail.FindStringSubmatch(pqErr.Detail); m != nil {
+		key = m[1]
+	}
+	return &ErrConflict{Key: key, Constraint: pqErr.Constraint, Err: err}
+}
@@ -0,0 +1,88 @@
+package sqlds
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// redactedPassword replaces passwords in the connection strings ConnInfo
+// returns.
+const redactedPassword = "****"
+
+// pgPasswordKeyword matches the password in a postgres keyword/value
+// connection string, quoted or not.
+var pgPasswordKeyword = regexp.MustCompile(`(^|\s)password\s*=\s*('(?:[^'\\]|\\.)*'|\S*)`)
+
+// ConnInfo returns the connection string the datastore was opened with,
+// its password replaced by ****, for logging. It is empty for datastores
+// made with NewDatastore.
+func (d *Datastore) ConnInfo() string {
+	return d.connInfo
+}
+
+// postgresConnInfo returns the redacted connection string CreatePostgres
+// and CreateCockroach connect with.
+func (opts *Options) postgresConnInfo() string {
+	if opts.ConnectionString != "" {
+		return redactPostgresDSN(opts.ConnectionString)
+	}
+	c := *opts
+	if c.Password != "" {
+		c.Password = redactedPassword
+	}
+	return c.dsn(c.Host, c.Port)
+}
+
+// mysqlConnInfo returns the redacted connection string CreateMySQL connects
+// with.
+func (opts *Options) mysqlConnInfo() string {
+	if opts.ConnectionString != "" {
+		cfg, err := mysql.ParseDSN(opts.ConnectionString)
+		if err != nil {
+			return ""
+		}
+		if cfg.Passwd != "" {
+			cfg.Passwd = redactedPassword
+		}
+		return cfg.FormatDSN()
+	}
+	c := *opts
+	if c.Password != "" {
+		c.Password = redactedPassword
+	}
+	return c.mysqlDSN()
+}
+
+// redactPostgresDSN replaces the password in a postgres connection string,
+// given either as a URL or as keyword/value pairs.
+func redactPostgresDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		return pgPasswordKeyword.ReplaceAllString(dsn, "${1}password="+redactedPassword)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return ""
+	}
+	// Rewrite the parameter in place, keeping the others as they were.
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		if strings.HasPrefix(p, "password=") {
+			params[i] = "password=" + redactedPassword
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+
+	// url.URL would escape the asterisks of a password set on it, so the
+	// redacted user info is put back by hand.
+	user := u.User
+	if _, ok := user.Password(); !ok {
+		return u.String()
+	}
+	u.User = nil
+	rest := strings.TrimPrefix(u.String(), u.Scheme+"://")
+	return u.Scheme + "://" + url.User(user.Username()).String() + ":" + redactedPassword + "@" + rest
+}
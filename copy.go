@@ -0,0 +1,143 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// defaultCopyBatchSize is the number of entries Copy writes per transaction
+// when no batch size is configured.
+const defaultCopyBatchSize = 1000
+
+// CopyOptions configure Copy.
+type CopyOptions struct {
+	// Prefix restricts the copy to the keys under it.
+	Prefix string
+	// OnConflict is what to do with keys already stored in the destination.
+	OnConflict ConflictPolicy
+	// BatchSize is the number of entries written per transaction. Defaults
+	// to 1000.
+	BatchSize int
+}
+
+// Copy streams the entries of the datastore into dst and returns the number
+// of keys written. dst may use another table or database, or another SQL
+// dialect. Entries are read with a single streaming query and written in
+// transactions of BatchSize entries, bulk loaded with Import where dst
+// supports it, so a failed copy leaves the batches before it written.
+func (d *Datastore) Copy(ctx context.Context, dst *Datastore, opts CopyOptions) (int64, error) {
+	size := opts.BatchSize
+	if size <= 0 {
+		size = defaultCopyBatchSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results, err := d.QueryChan(ctx, dsq.Query{Prefix: opts.Prefix})
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	chunk := make([]dsq.Entry, 0, size)
+	flush := func() error {
+		n, err := dst.importChunk(ctx, chunk, opts.OnConflict)
+		written += n
+		chunk = chunk[:0]
+		return err
+	}
+
+	for r := range results {
+		if r.Error != nil {
+			return written, r.Error
+		}
+		chunk = append(chunk, r.Entry)
+		if len(chunk) == size {
+			if err := flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return written, err
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// importChunk writes entries in one transaction, bulk loading them if the
+// datastore supports Import.
+func (d *Datastore) importChunk(ctx context.Context, entries []dsq.Entry, onConflict ConflictPolicy) (int64, error) {
+	if _, ok := d.queries.(ImportQueries); ok {
+		return d.Import(ctx, entries, ImportOptions{OnConflict: onConflict})
+	}
+	if err := d.coalesce.flushKeys(entryKeys(entries)); err != nil {
+		return 0, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d entries", len(entries))
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, keysError("import", many, d.poolError(ctxError(ctx, err), waits))
+	}
+	defer tx.Rollback()
+
+	var n int64
+	for _, e := range entries {
+		ok, err := putWithPolicy(ctx, tx, d.queries, e, onConflict)
+		if err == ErrKeyExists {
+			return 0, err
+		}
+		if err != nil {
+			return 0, keyError("import", e.Key, ctxError(ctx, err))
+		}
+		if ok {
+			n++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, keysError("import", many, ctxError(ctx, err))
+	}
+
+	if d.negCache != nil {
+		for _, e := range entries {
+			d.negCache.remove(e.Key)
+		}
+	}
+	return n, nil
+}
+
+// putWithPolicy writes e on tx unless its key is stored and onConflict says
+// otherwise, and reports whether it was written. It only relies on Put
+// writing absent keys, so it works whether Put overwrites or not.
+func putWithPolicy(ctx context.Context, tx *sql.Tx, queries Queries, e dsq.Entry, onConflict ConflictPolicy) (bool, error) {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, queries.Exists(), e.Key).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	if exists {
+		switch onConflict {
+		case ConflictSkip:
+			return false, nil
+		case ConflictError:
+			return false, ErrKeyExists
+		}
+		if _, err := tx.ExecContext(ctx, queries.Delete(), e.Key); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, queries.Put(), e.Key, e.Value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
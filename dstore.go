@@ -1,53 +1,541 @@
 package sqlds
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
 )
 
 var (
 	ErrInvalidType = errors.New("invalid value type")
+	ErrUnsupported = errors.New("operation not supported by queries")
+	// ErrPoolExhausted is returned when an operation's context expired
+	// while waiting for a connection because every pooled connection was
+	// in use.
+	ErrPoolExhausted = errors.New("connection pool exhausted")
+	// ErrInvalidQuery is returned for queries whose parameters cannot be
+	// expressed in SQL, such as a negative limit.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrKeyTooLong is returned when writing or deleting a key longer than
+	// the configured maximum key length.
+	ErrKeyTooLong = errors.New("key too long")
+	// ErrScanBudgetExceeded is returned when a query reads more value bytes
+	// than the configured scan budget allows.
+	ErrScanBudgetExceeded = errors.New("query exceeded its scan budget")
+	// ErrInvalidColumn is returned for a configured column name that isn't
+	// a plain identifier.
+	ErrInvalidColumn = errors.New("invalid column name")
+	// ErrClosed is the last result of a stream stopped by Close.
+	ErrClosed = errors.New("datastore closed")
 )
 
+// lsnPollInterval is how often a read waiting on an LSN re-checks replay
+// progress.
+const lsnPollInterval = 10 * time.Millisecond
+
+// defaultQueryBuffer is the number of results QueryChan buffers when no
+// buffer size is configured.
+const defaultQueryBuffer = 64
+
 type Queries interface {
 	Delete() string
 	Exists() string
 	Get() string
 	Put() string
 	Query() string
+	// Prefix returns the clauses restricting Query to keys matching the
+	// LIKE pattern bound to $1, in key order.
 	Prefix() string
 	Limit() string
 	Offset() string
 	GetSize() string
+	// TotalSize returns the sum of the sizes of every value, DiskUsage's
+	// fallback for databases that can't report the table's size on disk.
+	TotalSize() string
+	// ExistingKeys, DeleteMany, SizesMany and GetMany take the keys as an
+	// array bound to $1. Databases without array parameters return "",
+	// making the methods of the same names return ErrUnsupported.
+	ExistingKeys() string
+	Compact() string
+	DeletePrefix() string
+	DeleteMany() string
+	SizesMany() string
+	GetMany() string
+	QuoteIdent(name string) string
+	Reindex() string
+	Vacuum() string
+	Analyze() string
+	QuerySizes() string
+	// QueryKeysOnly is like Query, selecting only the key column.
+	QueryKeysOnly() string
+	// Empty reports whether the table holds no rows at all.
+	Empty() string
+	// LikeEscape is the escape character declared by the ESCAPE clauses of
+	// statements taking a LIKE pattern.
+	LikeEscape() rune
+}
+
+// PartialResultError is returned by queries that failed partway through
+// reading their rows. Entries holds the rows read before the failure, which
+// callers may use if a partial listing is acceptable.
+type PartialResultError struct {
+	Entries []dsq.Entry
+	Err     error
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("query failed after %d entries: %s", len(e.Entries), e.Err)
+}
+
+func (e *PartialResultError) Unwrap() error {
+	return e.Err
+}
+
+// NoLimitQueries is implemented by Queries for databases that can't take an
+// OFFSET without a LIMIT. NoLimit returns the clause placed before the
+// offset of queries that have no limit.
+type NoLimitQueries interface {
+	NoLimit() string
+}
+
+// OrderQueries is implemented by Queries that can order results by key in
+// SQL, letting queries ordered only by key skip sorting in Go. The order is
+// that of the key column's collation.
+type OrderQueries interface {
+	// OrderByKey and OrderByKeyDescending order Query and QuerySizes by key
+	// when there is no prefix.
+	OrderByKey() string
+	OrderByKeyDescending() string
+	// PrefixDescending is like Prefix, ordering by key descending instead.
+	PrefixDescending() string
+}
+
+// KeyLengthQueries is implemented by Queries that can order results by the
+// number of characters in their keys, then by key, in SQL.
+type KeyLengthQueries interface {
+	// PrefixByKeyLength is like Prefix, ordering by key length instead.
+	PrefixByKeyLength() string
+	// OrderByKeyLength orders Query and QuerySizes by key length when there
+	// is no prefix.
+	OrderByKeyLength() string
+}
+
+// LSNQueries is implemented by Queries for databases that expose a
+// write-ahead log position, allowing read-your-writes across replicas.
+type LSNQueries interface {
+	// CurrentLSN returns the current WAL write position.
+	CurrentLSN() string
+	// LSNReplayed returns whether the connection has applied the WAL up to
+	// the position given as the first argument.
+	LSNReplayed() string
+}
+
+// BloatQueries is implemented by Queries for databases that track dead
+// tuples left behind by updates and deletes.
+type BloatQueries interface {
+	// Bloat returns the live and dead tuple counts of the table.
+	Bloat() string
+}
+
+// DiskUsageQueries is implemented by Queries for databases that can report
+// the space a table takes on disk.
+type DiskUsageQueries interface {
+	// DiskUsage returns the size in bytes of the table, its indexes and
+	// its out-of-line storage.
+	DiskUsage() string
+}
+
+// BloatStats is an estimate of how much of the table is dead rows awaiting
+// vacuum.
+type BloatStats struct {
+	LiveTuples int64
+	DeadTuples int64
+	// DeadRatio is DeadTuples / LiveTuples, or 0 when there are no live
+	// tuples.
+	DeadRatio float64
+}
+
+// TimestampQueries is implemented by Queries for tables that record when
+// each key was created.
+type TimestampQueries interface {
+	// CreatedBetween selects key and data of entries created at or after the
+	// first argument and before the second, oldest first. It returns an
+	// empty string when the table has no creation timestamps.
+	CreatedBetween() string
+}
+
+// AccessQueries is implemented by Queries for tables that record when each
+// key was last read.
+type AccessQueries interface {
+	// Touch sets the access time of the key given as the first argument to
+	// now. It returns an empty string when access times aren't tracked.
+	Touch() string
+	// Accessed selects the access time of the key given as the first
+	// argument. It returns an empty string when access times aren't tracked.
+	Accessed() string
+}
+
+// TTLQueries is implemented by Queries for tables that record when each key
+// expires.
+type TTLQueries interface {
+	// PutExpiring is like Put, also setting the expiration to the third
+	// argument. It returns an empty string when the table has no
+	// expiration column.
+	PutExpiring() string
+	// ExpiringBefore selects key, data and expiration of entries that
+	// haven't expired yet but will by the first argument, soonest first,
+	// limited to the second argument. It returns an empty string when the
+	// table has no expiration column.
+	ExpiringBefore() string
+}
+
+// SeqQueries is implemented by Queries for tables that record insertion
+// order in a seq column.
+type SeqQueries interface {
+	// Events selects seq, key and data of entries whose seq is greater than
+	// the first argument, in seq order, limited to the second argument. It
+	// returns an empty string when the table has no seq column.
+	Events() string
+}
+
+// Event is an entry and its position in insertion order.
+type Event struct {
+	Seq   int64
+	Entry dsq.Entry
+}
+
+// ValueGroupQueries is implemented by Queries that can group entries by a
+// hash of their value.
+type ValueGroupQueries interface {
+	// DistinctValues selects the hex value hash and number of keys sharing
+	// it, for keys matching the LIKE pattern given as the first argument.
+	DistinctValues() string
+}
+
+// ValueGroup is a distinct value and how many keys hold it.
+type ValueGroup struct {
+	// Hash is the hex-encoded MD5 of the value.
+	Hash  string
+	Count int64
+}
+
+// MergeQueries is implemented by Queries that can lock rows for a
+// read-modify-write and overwrite values.
+type MergeQueries interface {
+	// LockValues selects key and data for the keys in the array given as
+	// the first argument, locking the rows until the transaction ends.
+	LockValues() string
+	// Upsert stores the value given as the second argument under the key
+	// given as the first, overwriting any existing value.
+	Upsert() string
+}
+
+// LargeObjectQueries is implemented by Queries for tables storing values in
+// large objects.
+type LargeObjectQueries interface {
+	// OrphanLargeObjects selects the OIDs of large objects the datastore
+	// created that the table no longer references. It returns an empty
+	// string when the table doesn't store large objects.
+	OrphanLargeObjects() string
+	// UnlinkOrphanLargeObjects unlinks those large objects and stops
+	// tracking them, selecting how many were unlinked.
+	UnlinkOrphanLargeObjects() string
+}
+
+// ExplainQueries is implemented by Queries for databases that can report
+// query plans as JSON.
+type ExplainQueries interface {
+	// Explain returns the statement printing stmt's plan as JSON.
+	Explain(stmt string) string
+}
+
+// PrefixQueries is implemented by Queries that can list the branches of the
+// key hierarchy.
+type PrefixQueries interface {
+	// NonEmptyPrefixes selects the distinct paths of keys matching the LIKE
+	// pattern given as the first argument, starting at the character
+	// position given as the second and truncated to the number of '/'
+	// separated segments given as the third.
+	NonEmptyPrefixes() string
+}
+
+// CursorQueries is implemented by Queries for databases with server-side
+// cursors, used to stream large result sets in bounded memory.
+type CursorQueries interface {
+	// DeclareKeysCursor declares a cursor over every key in the table.
+	DeclareKeysCursor(name string) string
+	// FetchCursor fetches the next count rows from the cursor.
+	FetchCursor(name string, count int) string
+	// CloseCursor closes the cursor.
+	CloseCursor(name string) string
+}
+
+// keysCursorFetch is how many keys AllKeys fetches from its cursor at a time.
+const keysCursorFetch = 1000
+
+// LSN is a write-ahead log position returned by PutWithLSN.
+type LSN string
+
+// ReadOption configures a read made with GetWithOptions.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	minLSN  LSN
+	primary bool
+}
+
+// WithMinLSN makes the read wait until the connection serving it has
+// replayed the WAL at least up to lsn. On a primary this is always true.
+func WithMinLSN(lsn LSN) ReadOption {
+	return func(o *readOptions) {
+		o.minLSN = lsn
+	}
+}
+
+// WithPrimary makes the read go to the primary even when reads are
+// routed to a replica, for reads that must see the datastore's own writes.
+func WithPrimary() ReadOption {
+	return func(o *readOptions) {
+		o.primary = true
+	}
+}
+
+// QueryOption configures a single QueryChan call.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	buffer int
+}
+
+// WithEarlyRelease makes QueryChan read up to max results ahead of the
+// consumer instead of the configured buffer size, trading memory for
+// connection availability: a result set of at most max entries releases its
+// connection as soon as it has been read, however slowly it is consumed.
+func WithEarlyRelease(max int) QueryOption {
+	return func(o *queryOptions) {
+		o.buffer = max
+	}
+}
+
+// BatchEvent describes the state of a batch when a lifecycle hook fires.
+type BatchEvent struct {
+	// Puts and Deletes are the number of operations queued in the batch's
+	// transaction so far.
+	Puts    int
+	Deletes int
+	// Err is the error that caused a rollback or failed commit, if any.
+	Err error
+}
+
+// BatchHooks are optional callbacks fired over the lifecycle of a batch's
+// transaction. Any of them may be nil.
+type BatchHooks struct {
+	Begin    func()
+	Commit   func(BatchEvent)
+	Rollback func(BatchEvent)
+}
+
+// Stats are counters of the work done by a Datastore.
+type Stats struct {
+	// Gets is the number of Get calls that queried the database.
+	Gets uint64
+	// NegativeCacheHits is the number of Get calls answered with
+	// ErrNotFound from the negative cache.
+	NegativeCacheHits uint64
+	// PreparedHits and PreparedMisses count single-key operations that
+	// found their prepared statement cached, and that had to prepare it,
+	// when statement caching is enabled.
+	PreparedHits   uint64
+	PreparedMisses uint64
+	// AcquireTime and ExecTime total the time single-key operations spent
+	// waiting for a connection and running their statements, when timings
+	// are reported.
+	AcquireTime time.Duration
+	ExecTime    time.Duration
 }
 
 type Datastore struct {
-	db      *sql.DB
-	queries Queries
+	db         *sql.DB
+	queries    Queries
+	batchHooks BatchHooks
+	negCache   *negativeCache
+	stats      Stats
+	validate   func(ds.Key) error
+
+	// conflictKey matches the key in constraint violations, if the key
+	// column isn't the default one.
+	conflictKey *regexp.Regexp
+
+	queryBuffer int
+
+	analyzeThreshold int64
+	txnRetries       int
+
+	breaker *circuitBreaker
+	stmts   *stmtCache
+
+	// replica, when set, serves Get, Has, GetSize and GetWithOptions.
+	replica *sql.DB
+
+	recorder func(Op)
+	timings  func(OpTiming)
+
+	legacyPrefixes bool
+
+	emptyCheckTTL time.Duration
+	empty         emptyCheck
+
+	maxScanBytes int64
+	sizeFallback bool
+
+	advisor  *indexAdvisor
+	seqScans *seqScanGuard
+	coalesce *coalescer
+	logger   *log.Logger
+
+	active       *activity
+	closeTimeout time.Duration
+
+	connInfo string
+
+	maxKeys int64
+	evictBy EvictionPolicy
+	reaper  *reaper
+}
+
+// emptyCheck caches the outcome of checking whether the table is empty.
+type emptyCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	empty   bool
+}
+
+// Stats returns a snapshot of the datastore's counters.
+func (d *Datastore) Stats() Stats {
+	stats := Stats{
+		Gets:              atomic.LoadUint64(&d.stats.Gets),
+		NegativeCacheHits: atomic.LoadUint64(&d.stats.NegativeCacheHits),
+		AcquireTime:       time.Duration(atomic.LoadInt64((*int64)(&d.stats.AcquireTime))),
+		ExecTime:          time.Duration(atomic.LoadInt64((*int64)(&d.stats.ExecTime))),
+	}
+	if d.stmts != nil {
+		stats.PreparedHits = atomic.LoadUint64(&d.stmts.hits)
+		stats.PreparedMisses = atomic.LoadUint64(&d.stmts.misses)
+	}
+	return stats
 }
 
 // NewDatastore returns a new datastore
 func NewDatastore(db *sql.DB, queries Queries) *Datastore {
-	return &Datastore{db: db, queries: queries}
+	return &Datastore{db: db, queries: queries, active: newActivity()}
+}
+
+// NewPostgresDatastore returns a datastore over an existing postgres table
+// with the key and data columns, leaving schema management to the caller:
+// unlike CreatePostgres it runs no DDL, so db's user needs no privileges
+// beyond reading and writing the table.
+func NewPostgresDatastore(db *sql.DB, tableName string) *Datastore {
+	return NewDatastore(db, NewQueriesForTable(tableName))
+}
+
+// ContextDatastore is the context-aware datastore interface of newer
+// go-datastore releases, in which every operation takes a context
+// cancelling its statement.
+type ContextDatastore interface {
+	GetContext(ctx context.Context, key ds.Key) ([]byte, error)
+	HasContext(ctx context.Context, key ds.Key) (bool, error)
+	GetSizeContext(ctx context.Context, key ds.Key) (int, error)
+	PutContext(ctx context.Context, key ds.Key, value []byte) error
+	DeleteContext(ctx context.Context, key ds.Key) error
+	QueryContext(ctx context.Context, q dsq.Query) (dsq.Results, error)
+}
+
+// TxBatch is implemented by the batches Batch and BatchContext return, for
+// callers that need to run their own statements atomically with a batch.
+type TxBatch interface {
+	ds.Batch
+	// GetTransaction returns the batch's transaction, beginning it if no
+	// operation has yet. Statements run on it commit or roll back together
+	// with the batch's puts and deletes. The batch owns the transaction:
+	// use it only until the batch's Commit, and don't Commit it directly.
+	// To abandon the batch, call Rollback on it; the batch's Commit then
+	// fails with sql.ErrTxDone.
+	GetTransaction() (*sql.Tx, error)
 }
 
 type batch struct {
-	db      *sql.DB
-	queries Queries
-	txn     *sql.Tx
+	ctx      context.Context
+	db       *sql.DB
+	queries  Queries
+	txn      *sql.Tx
+	hooks    BatchHooks
+	puts     int
+	deletes  int
+	negCache *negativeCache
+	putKeys  []string
+	validate func(ds.Key) error
+
+	conflictKey *regexp.Regexp
+
+	analyzeThreshold int64
+
+	rolledBack bool
+
+	recorder func(Op)
+	recorded []Op
+
+	// retries is how many times the transaction is replayed after a
+	// serialization failure. The operations are kept in ops for it, unless
+	// shared, once the transaction was handed out by GetTransaction and
+	// may hold statements the batch can't replay.
+	retries int
+	ops     []Op
+	shared  bool
+
+	// active counts the batch while its transaction is open.
+	active  *activity
+	counted bool
+
+	// taken holds the values the coalescer held for the keys the batch
+	// wrote, kept from landing after the commit and held again should the
+	// batch roll back.
+	coalesce *coalescer
+	taken    map[string][]byte
 }
 
 func (b *batch) GetTransaction() (*sql.Tx, error) {
+	b.shared = true
+	return b.begin()
+}
+
+// begin returns the batch's transaction, beginning it if needed.
+func (b *batch) begin() (*sql.Tx, error) {
 	if b.txn != nil {
 		return b.txn, nil
 	}
 
-	newTransaction, err := b.db.Begin()
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	newTransaction, err := b.db.BeginTx(b.ctx, nil)
 	if err != nil {
 		if newTransaction != nil {
 			newTransaction.Rollback()
@@ -57,18 +545,58 @@ func (b *batch) GetTransaction() (*sql.Tx, error) {
 	}
 
 	b.txn = newTransaction
+	if !b.counted {
+		b.counted = true
+		b.active.begin()
+	}
+	if b.hooks.Begin != nil {
+		b.hooks.Begin()
+	}
 	return newTransaction, nil
 }
 
+// uncount stops counting the batch as active, once its transaction ended.
+func (b *batch) uncount() {
+	if b.counted {
+		b.counted = false
+		b.active.end()
+	}
+}
+
+func (b *batch) event(err error) BatchEvent {
+	return BatchEvent{Puts: b.puts, Deletes: b.deletes, Err: err}
+}
+
+// rollback rolls the transaction back and fires the Rollback hook, once.
+func (b *batch) rollback(err error) {
+	if b.rolledBack {
+		return
+	}
+	b.rolledBack = true
+	if b.txn != nil {
+		b.txn.Rollback()
+	}
+	if len(b.taken) > 0 {
+		b.coalesce.hold(b.taken)
+		b.taken = nil
+	}
+	b.uncount()
+	if b.hooks.Rollback != nil {
+		b.hooks.Rollback(b.event(err))
+	}
+}
+
 func (b *batch) rollbackTxn(err error) {
-	if b.txn == nil {
+	// A retry that failed to begin again leaves no transaction, but the
+	// batch still needs rolling back.
+	if b.txn == nil && !b.counted {
 		return
 	}
 	if err != nil {
-		b.txn.Rollback()
+		b.rollback(err)
 	}
 	if r := recover(); r != nil {
-		b.txn.Rollback()
+		b.rollback(fmt.Errorf("panic: %v", r))
 		// Re-panic so that callers can potentially handle it.
 		panic(r)
 	}
@@ -81,35 +609,148 @@ func (b *batch) Put(key ds.Key, val []byte) (err error) {
 		return ErrInvalidType
 	}
 
-	txn, err := b.GetTransaction()
-	if err != nil {
-		return err
+	if b.validate != nil {
+		if err := b.validate(key); err != nil {
+			return err
+		}
 	}
 
-	_, err = txn.Exec(b.queries.Put(), key.String(), val)
-	if err != nil {
+	op := Op{Type: OpPut, Key: key.String(), ValueLen: len(val), Value: val}
+	if err := b.exec(op); err != nil {
 		return err
 	}
 
+	b.puts++
+	if b.negCache != nil {
+		b.putKeys = append(b.putKeys, key.String())
+	}
+	if b.recorder != nil {
+		b.recorded = append(b.recorded, op)
+	}
 	return nil
 }
 
 func (b *batch) Delete(key ds.Key) (err error) {
 	defer func() { b.rollbackTxn(err) }()
 
-	txn, err := b.GetTransaction()
-	if err != nil {
+	if b.validate != nil {
+		if err := b.validate(key); err != nil {
+			return err
+		}
+	}
+
+	op := Op{Type: OpDelete, Key: key.String()}
+	if err := b.exec(op); err != nil {
 		return err
 	}
 
-	_, err = txn.Exec(b.queries.Delete(), key.String())
+	b.deletes++
+	if b.recorder != nil {
+		b.recorded = append(b.recorded, op)
+	}
+	return nil
+}
+
+// exec runs op in the batch's transaction, replaying the transaction if a
+// serialization failure aborted it, and keeps op for later replays.
+func (b *batch) exec(op Op) error {
+	name := "put"
+	if op.Type == OpDelete {
+		name = "delete"
+	}
+	txn, err := b.begin()
 	if err != nil {
-		return err
+		return keyError(name, op.Key, err)
+	}
+	b.take(op.Key)
+
+	err = b.execOp(txn, op)
+	if err != nil && b.retryable(err) {
+		err = b.retry(&op, false)
+	}
+	if err != nil {
+		return keyError(name, op.Key, conflictError(err, op.Key, b.conflictKey))
+	}
+
+	if b.retries > 0 && !b.shared {
+		if op.Value != nil {
+			// The caller may reuse the value once Put returns.
+			op.Value = append([]byte{}, op.Value...)
+		}
+		b.ops = append(b.ops, op)
+	}
+	return nil
+}
+
+// take takes the value the coalescer holds for key, once any flush writing
+// it is done, as the batch's write to key replaces it.
+func (b *batch) take(key string) {
+	c := b.coalesce
+	if c == nil {
+		return
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if v, ok := c.take(key); ok {
+		if b.taken == nil {
+			b.taken = make(map[string][]byte)
+		}
+		b.taken[key] = v
+	}
+}
+
+func (b *batch) execOp(txn *sql.Tx, op Op) error {
+	var err error
+	switch op.Type {
+	case OpPut:
+		_, err = txn.ExecContext(b.ctx, b.queries.Put(), op.Key, op.Value)
+	case OpDelete:
+		_, err = txn.ExecContext(b.ctx, b.queries.Delete(), op.Key)
 	}
+	return err
+}
+
+// retryable reports whether the transaction can be replayed after err.
+func (b *batch) retryable(err error) bool {
+	return b.retries > 0 && !b.shared && isSerializationFailure(err)
+}
+
+// retry begins the transaction again and replays the operations kept so
+// far followed by op, if any, committing them too when commit is set,
+// until that succeeds, fails otherwise, or b.retries attempts are spent.
+// Each attempt fires the Begin hook.
+func (b *batch) retry(op *Op, commit bool) error {
+	var err error
+	for attempt := 0; attempt < b.retries; attempt++ {
+		b.txn.Rollback()
+		b.txn = nil
 
+		var txn *sql.Tx
+		if txn, err = b.begin(); err != nil {
+			return err
+		}
+		if err = b.replay(txn, op); err == nil && commit {
+			err = txn.Commit()
+		}
+		if err == nil || !isSerializationFailure(err) {
+			return err
+		}
+	}
 	return err
 }
 
+func (b *batch) replay(txn *sql.Tx, op *Op) error {
+	for _, o := range b.ops {
+		if err := b.execOp(txn, o); err != nil {
+			return err
+		}
+	}
+	if op != nil {
+		return b.execOp(txn, *op)
+	}
+	return nil
+}
+
 func (b *batch) Commit() error {
 	// We do not return an error here, because there may be a garbage
 	// collection flushing the cache like in the case of provider manager
@@ -118,152 +759,2245 @@ func (b *batch) Commit() error {
 		return nil
 	}
 
+	// The transaction was already rolled back when the context was
+	// cancelled; report that the batch was dropped.
+	if err := b.ctx.Err(); err != nil {
+		b.rollback(err)
+		return err
+	}
+
 	var err = b.txn.Commit()
+	if err != nil && b.retryable(err) {
+		err = b.retry(nil, true)
+	}
 	if err != nil {
-		b.txn.Rollback()
-		return err
+		b.rollback(err)
+		if err == sql.ErrTxDone {
+			// GetTransaction's caller rolled it back, as documented.
+			return err
+		}
+		return keysError("commit", "batch", conflictError(err, "", b.conflictKey))
+	}
+	b.taken = nil
+	b.uncount()
+
+	// Invalidate only once the writes are visible, so a concurrent Get
+	// cannot re-cache a key as missing in between.
+	for _, k := range b.putKeys {
+		b.negCache.remove(k)
+	}
+
+	analyzeAfter(b.db, b.queries, int64(b.puts+b.deletes), b.analyzeThreshold)
+
+	for _, op := range b.recorded {
+		b.recorder(op)
 	}
 
+	if b.hooks.Commit != nil {
+		b.hooks.Commit(b.event(nil))
+	}
 	return nil
 }
 
+// Batch returns a batch whose operations run in a single transaction,
+// begun by the first of them and committed by Commit. The batch is a
+// TxBatch.
 func (d *Datastore) Batch() (ds.Batch, error) {
+	return d.BatchContext(context.Background())
+}
+
+// BatchContext is like Batch, but ties the batch's transaction to ctx.
+// Cancelling ctx before Commit rolls the transaction back and releases its
+// connection; later operations and Commit then return ctx.Err() without
+// touching the database.
+func (d *Datastore) BatchContext(ctx context.Context) (ds.Batch, error) {
 	batch := &batch{
-		db:      d.db,
-		queries: d.queries,
-		txn:     nil,
+		ctx:      ctx,
+		db:       d.db,
+		queries:  d.queries,
+		txn:      nil,
+		hooks:    d.batchHooks,
+		negCache: d.negCache,
+		validate: d.validate,
+		recorder: d.recorder,
+
+		conflictKey:      d.conflictKey,
+		analyzeThreshold: d.analyzeThreshold,
+		retries:          d.txnRetries,
+		active:           d.active,
+		coalesce:         d.coalesce,
 	}
 
 	return batch, nil
 }
 
+// Close closes the datastore. Unless Options.CloseTimeout is set, streams
+// still being read are stopped at once rather than waited for.
 func (d *Datastore) Close() error {
-	return d.db.Close()
-}
+	if d.closeTimeout > 0 {
+		d.active.wait(d.closeTimeout)
+	}
+	d.active.stop()
+	d.reaper.close()
 
-func (d *Datastore) Delete(key ds.Key) error {
-	result, err := d.db.Exec(d.queries.Delete(), key.String())
-	if err != nil {
+	// Write held puts while the pool is still open.
+	flushErr := d.coalesce.close()
+	if d.stmts != nil {
+		d.stmts.close()
+	}
+	if d.replica != nil {
+		d.replica.Close()
+	}
+	if err := d.db.Close(); err != nil {
 		return err
 	}
+	return flushErr
+}
 
-	rows, err := result.RowsAffected()
-	if err != nil {
+// DB returns the datastore's connection pool, such as to run maintenance
+// statements or inspect its Stats. Closing it closes the datastore. Reads
+// served by a read replica use a separate pool, which DB doesn't return.
+func (d *Datastore) DB() *sql.DB {
+	return d.db
+}
+
+// Ping checks that the database, and the read replica if one is configured,
+// can be reached, returning as soon as ctx is done.
+func (d *Datastore) Ping(ctx context.Context) error {
+	if err := pingContext(ctx, d.db); err != nil {
 		return err
 	}
-
-	if rows == 0 {
-		return ds.ErrNotFound
+	if d.replica != nil {
+		return pingContext(ctx, d.replica)
 	}
-
 	return nil
 }
 
-func (d *Datastore) Get(key ds.Key) (value []byte, err error) {
-	row := d.db.QueryRow(d.queries.Get(), key.String())
-	var out []byte
-
-	switch err := row.Scan(&out); err {
-	case sql.ErrNoRows:
-		return nil, ds.ErrNotFound
-	case nil:
-		return out, nil
-	default:
-		return nil, err
+// reader returns the pool serving single-key reads.
+func (d *Datastore) reader() *sql.DB {
+	if d.replica != nil {
+		return d.replica
 	}
+	return d.db
 }
 
-func (d *Datastore) Has(key ds.Key) (exists bool, err error) {
-	row := d.db.QueryRow(d.queries.Exists(), key.String())
+// dbConn is the subset of *sql.DB and *sql.Conn the single-key operations
+// run their statements on.
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
 
-	switch err := row.Scan(&exists); err {
-	case sql.ErrNoRows:
-		return exists, nil
-	case nil:
-		return exists, nil
-	default:
-		return exists, err
+// run calls fn with db to run the statements of the single-key operation
+// op. When timings are reported, fn is instead given a connection acquired
+// from db up front, so the time spent waiting for it can be told apart from
+// the time fn spends executing.
+func (d *Datastore) run(ctx context.Context, db *sql.DB, op string, fn func(c dbConn) error) error {
+	if d.timings == nil {
+		return fn(db)
 	}
+	return d.runConn(ctx, db, op, func(conn *sql.Conn) error { return fn(conn) })
 }
 
-func (d *Datastore) Put(key ds.Key, value []byte) error {
-	if value == nil {
-		return ErrInvalidType
+// runConn is like run for operations whose statements must share a
+// session, always giving fn a connection acquired from db up front.
+func (d *Datastore) runConn(ctx context.Context, db *sql.DB, op string, fn func(conn *sql.Conn) error) error {
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	acquired := time.Now()
+	if err == nil {
+		err = fn(conn)
+		conn.Close()
+	}
+	if d.timings != nil {
+		d.recordTiming(OpTiming{Type: op, Acquire: acquired.Sub(start), Exec: time.Since(acquired)})
 	}
+	return err
+}
 
-	_, err := d.db.Exec(d.queries.Put(), key.String(), value)
+// exec runs a single-key statement on c, prepared if statement caching is
+// enabled and c is the primary pool.
+func (d *Datastore) exec(ctx context.Context, c dbConn, query string, args ...interface{}) (sql.Result, error) {
+	if d.stmts == nil || c != dbConn(d.db) {
+		return c.ExecContext(ctx, query, args...)
+	}
+	stmt, err := d.stmts.prepare(query)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return stmt.ExecContext(ctx, args...)
+}
 
-	return nil
+// queryRow is like exec, for statements returning a single row. Only
+// statements on the primary are prepared. If the statement can't be
+// prepared, it runs unprepared so the error surfaces from Scan.
+func (d *Datastore) queryRow(ctx context.Context, c dbConn, query string, args ...interface{}) *sql.Row {
+	if d.stmts == nil || c != dbConn(d.db) {
+		return c.QueryRowContext(ctx, query, args...)
+	}
+	stmt, err := d.stmts.prepare(query)
+	if err != nil {
+		return c.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
 }
 
-func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
-	raw, err := d.RawQuery(q)
+// rawRow is like queryRow, returning Rows for reads that scan the driver's
+// buffer directly, which Row doesn't allow.
+func (d *Datastore) rawRow(ctx context.Context, c dbConn, query string, args ...interface{}) (*sql.Rows, error) {
+	if d.stmts == nil || c != dbConn(d.db) {
+		return c.QueryContext(ctx, query, args...)
+	}
+	stmt, err := d.stmts.prepare(query)
 	if err != nil {
 		return nil, err
 	}
+	return stmt.QueryContext(ctx, args...)
+}
 
-	for _, f := range q.Filters {
-		raw = dsq.NaiveFilter(raw, f)
+// ctxError returns ctx's error in place of err when ctx ended while the
+// statement ran, so callers see context.Canceled or
+// context.DeadlineExceeded rather than the driver's cancellation error.
+func ctxError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
+	return err
+}
 
-	raw = dsq.NaiveOrder(raw, q.Orders...)
+// keyError wraps a driver error from op on key, so logs show which
+// operation and key failed. ctx.Err() and ErrPoolExhausted are returned as
+// they are, like this package's other errors, which never pass through it,
+// so callers can keep comparing them directly.
+func keyError(op, key string, err error) error {
+	return keysError(op, fmt.Sprintf("key %q", key), err)
+}
 
-	return raw, nil
+// keysError is keyError for operations on several keys, described by keys,
+// such as the prefix they share.
+func keysError(op, keys string, err error) error {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded || err == ErrPoolExhausted {
+		return err
+	}
+	return fmt.Errorf("sqlds: %s %s: %w", op, keys, err)
 }
 
-func (d *Datastore) RawQuery(q dsq.Query) (dsq.Results, error) {
-	var rows *sql.Rows
-	var err error
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.DeleteContext(context.Background(), key)
+}
 
-	if q.Prefix != "" {
-		rows, err = QueryWithParams(d, q)
-	} else {
-		rows, err = d.db.Query(d.queries.Query())
+// DeleteContext is like Delete, aborting the statement when ctx is done.
+func (d *Datastore) DeleteContext(ctx context.Context, key ds.Key) (err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpDelete, Key: key.String()}, err) }()
 	}
 
-	if err != nil {
-		return nil, err
+	if err := d.validateKey(key); err != nil {
+		return err
 	}
 
-	var entries []dsq.Entry
-	defer rows.Close()
+	if c := d.coalesce; c != nil {
+		// A held put must not land after, and undo, the delete.
+		c.writing.Lock()
+		defer c.writing.Unlock()
+		if c.drop(key.String()) {
+			defer func() {
+				if err == ds.ErrNotFound {
+					err = nil
+				}
+			}()
+		}
+	}
 
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	waits := d.db.Stats().WaitCount
+	var result sql.Result
+	err = d.run(ctx, d.db, OpDelete, func(c dbConn) error {
+		var err error
+		result, err = d.exec(ctx, c, d.queries.Delete(), key.String())
+		return err
+	})
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	if err != nil {
+		return keyError("delete", key.String(), err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return keyError("delete", key.String(), err)
+	}
+
+	if rows == 0 {
+		return ds.ErrNotFound
+	}
+
+	return nil
+}
+
+// Get returns the value stored at key. The returned slice is newly
+// allocated and owned by the caller; see GetInto to reuse a buffer instead.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, aborting the statement when ctx is done.
+func (d *Datastore) GetContext(ctx context.Context, key ds.Key) ([]byte, error) {
+	return d.get(ctx, key, readOptions{})
+}
+
+// get is GetContext with the options given to GetWithOptions. A read
+// waiting on a WAL position runs on a single connection, so that the value
+// is read from the server that replayed it.
+func (d *Datastore) get(ctx context.Context, key ds.Key, o readOptions) (value []byte, err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpGet, Key: key.String(), ValueLen: len(value)}, err) }()
+	}
+
+	if v, ok := d.coalesce.get(key.String()); ok {
+		return append([]byte{}, v...), nil
+	}
+
+	if d.negCache != nil && d.negCache.has(key.String()) {
+		atomic.AddUint64(&d.stats.NegativeCacheHits, 1)
+		return nil, ds.ErrNotFound
+	}
+
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	db := d.reader()
+	if o.primary {
+		db = d.db
+	}
+	read := func(c dbConn) error {
+		return d.queryRow(ctx, c, d.queries.Get(), key.String()).Scan(&value)
+	}
+
+	atomic.AddUint64(&d.stats.Gets, 1)
+	var gen uint64
+	if d.negCache != nil {
+		gen = d.negCache.begin(key.String())
+	}
+	waits := d.db.Stats().WaitCount
+	if o.minLSN != "" {
+		err = d.runConn(ctx, db, OpGet, func(conn *sql.Conn) error {
+			if err := d.waitForLSN(ctx, conn, o.minLSN); err != nil {
+				return err
+			}
+			return read(conn)
+		})
+	} else {
+		err = d.run(ctx, db, OpGet, read)
+	}
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	// A lagging replica may not have a key written moments ago, so only
+	// misses seen on the primary are cached.
+	if d.negCache != nil {
+		d.negCache.end(key.String(), gen, err == sql.ErrNoRows && db == d.db)
+	}
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	case nil:
+		if err := d.touch(ctx, d.db, key); err != nil {
+			return nil, keyError("get", key.String(), err)
+		}
+		return value, nil
+	default:
+		return nil, keyError("get", key.String(), err)
+	}
+}
+
+// touch records that key was read, when the table tracks access times. c
+// must be to the primary, even for reads served by a replica.
+func (d *Datastore) touch(ctx context.Context, c dbConn, key ds.Key) error {
+	aq, ok := d.queries.(AccessQueries)
+	if !ok || aq.Touch() == "" {
+		return nil
+	}
+	_, err := c.ExecContext(ctx, aq.Touch(), key.String())
+	return ctxError(ctx, err)
+}
+
+// GetAccessed returns when key was last read, or first written if it hasn't
+// been read since. It requires the table to have been created with access
+// times enabled.
+func (d *Datastore) GetAccessed(ctx context.Context, key ds.Key) (time.Time, error) {
+	aq, ok := d.queries.(AccessQueries)
+	if !ok || aq.Accessed() == "" {
+		return time.Time{}, ErrUnsupported
+	}
+
+	waits := d.db.Stats().WaitCount
+	var at time.Time
+	switch err := d.db.QueryRowContext(ctx, aq.Accessed(), key.String()).Scan(&at); err {
+	case sql.ErrNoRows:
+		return time.Time{}, ds.ErrNotFound
+	case nil:
+		return at, nil
+	default:
+		return time.Time{}, keyError("get accessed", key.String(), d.poolError(ctxError(ctx, err), waits))
+	}
+}
+
+// GetInto appends the value stored at key to dst and returns the extended
+// slice, like append, so a hot loop can read many values into one buffer
+// without allocating for each. The value is copied out of the driver's
+// buffer before GetInto returns, so the result only aliases dst, and stays
+// valid until the caller reuses dst.
+func (d *Datastore) GetInto(ctx context.Context, key ds.Key, dst []byte) (value []byte, err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpGet, Key: key.String(), ValueLen: len(value) - len(dst)}, err) }()
+	}
+
+	if v, ok := d.coalesce.get(key.String()); ok {
+		return append(dst, v...), nil
+	}
+
+	if d.negCache != nil && d.negCache.has(key.String()) {
+		atomic.AddUint64(&d.stats.NegativeCacheHits, 1)
+		return dst, ds.ErrNotFound
+	}
+
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return dst, err
+	}
+
+	atomic.AddUint64(&d.stats.Gets, 1)
+	var gen uint64
+	if d.negCache != nil {
+		gen = d.negCache.begin(key.String())
+	}
+	waits := d.db.Stats().WaitCount
+	value = dst
+	err = d.run(ctx, d.reader(), OpGet, func(c dbConn) error {
+		var err error
+		value, err = d.getInto(ctx, c, key, dst)
+		return err
+	})
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	if d.negCache != nil {
+		d.negCache.end(key.String(), gen, err == ds.ErrNotFound && d.replica == nil)
+	}
+
+	switch err {
+	case ds.ErrNotFound:
+		return dst, err
+	case nil:
+		if err := d.touch(ctx, d.db, key); err != nil {
+			return dst, keyError("get", key.String(), err)
+		}
+		return value, nil
+	default:
+		return dst, keyError("get", key.String(), err)
+	}
+}
+
+func (d *Datastore) getInto(ctx context.Context, c dbConn, key ds.Key, dst []byte) ([]byte, error) {
+	rows, err := d.rawRow(ctx, c, d.queries.Get(), key.String())
+	if err != nil {
+		return dst, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return dst, err
+		}
+		return dst, ds.ErrNotFound
+	}
+
+	// RawBytes points into the driver's buffer, which the next call to
+	// Next or Close overwrites, so it is copied into dst here.
+	var raw sql.RawBytes
+	if err := rows.Scan(&raw); err != nil {
+		return dst, err
+	}
+	return append(dst, raw...), rows.Close()
+}
+
+// PutWithLSN stores the value like Put and returns the WAL position after the
+// write, which can be passed to WithMinLSN to read it back from a replica.
+// The value is written at once, even with a coalescer, so that the position
+// covers it.
+func (d *Datastore) PutWithLSN(ctx context.Context, key ds.Key, value []byte) (LSN, error) {
+	lq, ok := d.queries.(LSNQueries)
+	if !ok {
+		return "", ErrUnsupported
+	}
+	if c := d.coalesce; c != nil {
+		// A held put must not land after, and replace, this one.
+		c.writing.Lock()
+		defer c.writing.Unlock()
+		c.drop(key.String())
+	}
+	if err := d.put(ctx, key, value, d.queries.Put()); err != nil {
+		return "", err
+	}
+
+	var lsn LSN
+	waits := d.db.Stats().WaitCount
+	if err := d.db.QueryRowContext(ctx, lq.CurrentLSN()).Scan(&lsn); err != nil {
+		return "", keyError("put", key.String(), d.poolError(ctxError(ctx, err), waits))
+	}
+	return lsn, nil
+}
+
+// GetWithOptions fetches the value like Get, honoring the given options.
+func (d *Datastore) GetWithOptions(ctx context.Context, key ds.Key, opts ...ReadOption) ([]byte, error) {
+	var o readOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, ok := d.queries.(LSNQueries); o.minLSN != "" && !ok {
+		return nil, ErrUnsupported
+	}
+	return d.get(ctx, key, o)
+}
+
+// GetPrimary fetches the value from the primary, like GetWithOptions with
+// WithPrimary.
+func (d *Datastore) GetPrimary(ctx context.Context, key ds.Key) ([]byte, error) {
+	return d.GetWithOptions(ctx, key, WithPrimary())
+}
+
+// waitForLSN blocks until conn has replayed the WAL up to lsn, or ctx is done.
+// The queries must implement LSNQueries.
+func (d *Datastore) waitForLSN(ctx context.Context, conn *sql.Conn, lsn LSN) error {
+	lq := d.queries.(LSNQueries)
+	for {
+		var replayed bool
+		if err := conn.QueryRowContext(ctx, lq.LSNReplayed(), string(lsn)).Scan(&replayed); err != nil {
+			return err
+		}
+		if replayed {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lsnPollInterval):
+		}
+	}
+}
+
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return d.HasContext(context.Background(), key)
+}
+
+// HasContext is like Has, aborting the statement when ctx is done.
+func (d *Datastore) HasContext(ctx context.Context, key ds.Key) (exists bool, err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpHas, Key: key.String()}, err) }()
+	}
+
+	if _, ok := d.coalesce.get(key.String()); ok {
+		return true, nil
+	}
+
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return false, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	err = d.run(ctx, d.reader(), OpHas, func(c dbConn) error {
+		return d.queryRow(ctx, c, d.queries.Exists(), key.String()).Scan(&exists)
+	})
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+
+	switch err {
+	case sql.ErrNoRows:
+		return exists, nil
+	case nil:
+		return exists, nil
+	default:
+		return exists, keyError("has", key.String(), err)
+	}
+}
+
+// poolError maps a context deadline hit while the pool was saturated to
+// ErrPoolExhausted. waits is the pool's WaitCount from before the operation
+// started; a higher count now means some caller had to wait for a
+// connection.
+func (d *Datastore) poolError(err error, waits int64) error {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	stats := d.db.Stats()
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections && stats.WaitCount > waits {
+		return ErrPoolExhausted
+	}
+	return err
+}
+
+// keyLengthValidator returns a key validator rejecting keys longer than max
+// characters with ErrKeyTooLong, before calling next, if any.
+func keyLengthValidator(max int, next func(ds.Key) error) func(ds.Key) error {
+	return func(key ds.Key) error {
+		if n := utf8.RuneCountInString(key.String()); n > max {
+			return fmt.Errorf("%w: %d characters, maximum is %d", ErrKeyTooLong, n, max)
+		}
+		if next != nil {
+			return next(key)
+		}
+		return nil
+	}
+}
+
+// validateKey runs the configured key validator, if any.
+func (d *Datastore) validateKey(key ds.Key) error {
+	if d.validate == nil {
+		return nil
+	}
+	return d.validate(key)
+}
+
+// Put stores value under key, overwriting any existing value. An empty
+// value is stored as such, but a nil one returns ErrInvalidType, as it
+// does in batches, so that a missing value can't pass for an empty one.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put, aborting the statement when ctx is done.
+func (d *Datastore) PutContext(ctx context.Context, key ds.Key, value []byte) error {
+	if d.coalesce != nil {
+		return d.coalescePut(ctx, key, value)
+	}
+	return d.put(ctx, key, value, d.queries.Put())
+}
+
+// coalescePut holds a copy of value for the coalescer to write, or writes it
+// at once if the coalescer was closed.
+func (d *Datastore) coalescePut(ctx context.Context, key ds.Key, value []byte) (err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpPut, Key: key.String(), ValueLen: len(value), Value: value}, err) }()
+	}
+
+	if value == nil {
+		return ErrInvalidType
+	}
+
+	if err := d.validateKey(key); err != nil {
+		return err
+	}
+
+	if !d.coalesce.put(key.String(), append([]byte{}, value...)) {
+		return d.write(ctx, key, value, d.queries.Put())
+	}
+	return nil
+}
+
+// PutWithTTL stores the value like Put, expiring it ttl from now.
+func (d *Datastore) PutWithTTL(ctx context.Context, key ds.Key, value []byte, ttl time.Duration) error {
+	return d.PutWithExpireAt(ctx, key, value, time.Now().Add(ttl))
+}
+
+// PutWithExpireAt stores the value like Put, expiring it at t. It requires
+// the table to have been created with TTL enabled.
+func (d *Datastore) PutWithExpireAt(ctx context.Context, key ds.Key, value []byte, t time.Time) error {
+	tq, ok := d.queries.(TTLQueries)
+	if !ok || tq.PutExpiring() == "" {
+		return ErrUnsupported
+	}
+	if c := d.coalesce; c != nil {
+		// A held put must not land after, and replace, this one.
+		c.writing.Lock()
+		defer c.writing.Unlock()
+		c.drop(key.String())
+	}
+	return d.put(ctx, key, value, tq.PutExpiring(), t)
+}
+
+// put writes value under key with stmt, which takes the key and value as
+// its first two arguments, followed by extra.
+func (d *Datastore) put(ctx context.Context, key ds.Key, value []byte, stmt string, extra ...interface{}) (err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpPut, Key: key.String(), ValueLen: len(value), Value: value}, err) }()
+	}
+
+	if value == nil {
+		return ErrInvalidType
+	}
+
+	if err := d.validateKey(key); err != nil {
+		return err
+	}
+
+	return d.write(ctx, key, value, stmt, extra...)
+}
+
+// write runs put's statement, without validating or recording it.
+func (d *Datastore) write(ctx context.Context, key ds.Key, value []byte, stmt string, extra ...interface{}) error {
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	waits := d.db.Stats().WaitCount
+	args := append([]interface{}{key.String(), value}, extra...)
+	err = d.run(ctx, d.db, OpPut, func(c dbConn) error {
+		_, err := d.exec(ctx, c, stmt, args...)
+		return err
+	})
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	if err != nil {
+		return keyError("put", key.String(), err)
+	}
+
+	if d.negCache != nil {
+		d.negCache.remove(key.String())
+	}
+	return nil
+}
+
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext is like Query, aborting the statement when ctx is done.
+// Results are read in full before it returns, so ctx only governs the call
+// itself and not the use of the results.
+func (d *Datastore) QueryContext(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if err := validateQuery(q); err != nil {
+		return nil, err
+	}
+	if err := d.coalesce.flushPrefix(q.Prefix); err != nil {
+		return nil, err
+	}
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	results, err := d.query(ctx, d.db, q, nil)
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	return results, err
+}
+
+// QueryStats describes how a query was answered.
+type QueryStats struct {
+	// RowsScanned is the number of rows read from the database, before
+	// any filtering, ordering, limit or offset applied in Go.
+	RowsScanned int
+	// RowsReturned and BytesReturned count the results and the sizes of
+	// their values.
+	RowsReturned  int
+	BytesReturned int64
+	// Duration is the time taken to run the query and read its results.
+	Duration time.Duration
+	// NaiveFilter and NaiveOrder report whether filters or orders had to
+	// be applied in Go rather than in SQL.
+	NaiveFilter bool
+	NaiveOrder  bool
+}
+
+// QueryWithStats runs q like QueryContext, reading its results in full, and
+// reports how it was answered. Comparing rows scanned to rows returned shows
+// whether the query's filters were pushed into SQL.
+func (d *Datastore) QueryWithStats(ctx context.Context, q dsq.Query) (dsq.Results, QueryStats, error) {
+	var stats QueryStats
+	start := time.Now()
+	if err := validateQuery(q); err != nil {
+		return nil, stats, err
+	}
+	if err := d.coalesce.flushPrefix(q.Prefix); err != nil {
+		return nil, stats, err
+	}
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return nil, stats, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	results, err := d.query(ctx, d.db, q, &stats)
+	err = d.poolError(ctxError(ctx, err), waits)
+	d.breaker.record(probe, err)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, stats, err
+	}
+	for _, e := range entries {
+		if e.Size > 0 {
+			stats.BytesReturned += int64(e.Size)
+		}
+	}
+	stats.RowsReturned = len(entries)
+	stats.Duration = time.Since(start)
+	return dsq.ResultsWithEntries(q, entries), stats, nil
+}
+
+// AnnotatedResults are the results of QueryAnnotated.
+type AnnotatedResults struct {
+	dsq.Results
+	// TableEmpty reports whether the table held no keys at all, telling an
+	// empty datastore apart from a query that matched none of its keys.
+	TableEmpty bool
+}
+
+// QueryAnnotated runs q like QueryContext and reports alongside its results
+// whether the table is empty. The check is reused for the datastore's
+// EmptyCheckTTL, so writes made within that time, through this datastore or
+// any other client, may not be reflected in it yet.
+func (d *Datastore) QueryAnnotated(ctx context.Context, q dsq.Query) (*AnnotatedResults, error) {
+	results, err := d.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	empty, err := d.tableEmpty(ctx)
+	if err != nil {
+		results.Close()
+		return nil, err
+	}
+	return &AnnotatedResults{Results: results, TableEmpty: empty}, nil
+}
+
+// tableEmpty reports whether the table is empty, checking it at most once
+// per emptyCheckTTL. Concurrent callers share a single check.
+func (d *Datastore) tableEmpty(ctx context.Context) (bool, error) {
+	c := &d.empty
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < d.emptyCheckTTL {
+		return c.empty, nil
+	}
+
+	var empty bool
+	waits := d.db.Stats().WaitCount
+	if err := d.db.QueryRowContext(ctx, d.queries.Empty()).Scan(&empty); err != nil {
+		return false, d.poolError(ctxError(ctx, err), waits)
+	}
+	c.checked = time.Now()
+	c.empty = empty
+	return empty, nil
+}
+
+// querier is the subset of *sql.DB and *sql.Tx needed to run queries.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// query runs q on db, recording how it was answered in stats unless nil.
+func (d *Datastore) query(ctx context.Context, db querier, q dsq.Query, stats *QueryStats) (dsq.Results, error) {
+	if err := validateQuery(q); err != nil {
+		return nil, err
+	}
+
+	// Filters and orders are applied in Go, so limit and offset must be too:
+	// applying them in SQL first would page over a different sequence than
+	// the one returned. A lone key or key length order and filters
+	// restricting keys to a prefix or a single key are applied in SQL
+	// instead.
+	ordered := sqlOrderOf(d.queries, q.Orders) != unordered
+	split := splitFilters(d.normalizeQuery(q).Prefix, q.Filters)
+	naive := len(split.rest) > 0 || (len(q.Orders) > 0 && !ordered)
+	rq := q
+	rq.Filters = split.pushed
+	if naive {
+		rq.Limit = 0
+		rq.Offset = 0
+	}
+
+	raw, err := d.rawQuery(ctx, db, rq, stats)
+	if err != nil {
+		return nil, err
+	}
+	if stats != nil {
+		stats.NaiveFilter = len(split.rest) > 0
+		stats.NaiveOrder = len(q.Orders) > 0 && !ordered
+	}
+
+	for _, f := range split.rest {
+		raw = dsq.NaiveFilter(raw, f)
+	}
+
+	// dsq.Less breaks ties between equal entries by key, and keys are
+	// unique, so this order is total and repeated queries page the same way.
+	if !ordered {
+		raw = dsq.NaiveOrder(raw, q.Orders...)
+	}
+
+	if naive {
+		raw = dsq.NaiveOffset(raw, q.Offset)
+		raw = dsq.NaiveLimit(raw, q.Limit)
+	}
+	if naive || len(split.pushed) > 0 {
+		raw = dsq.ResultsReplaceQuery(raw, q)
+	}
+
+	return raw, nil
+}
+
+func (d *Datastore) RawQuery(q dsq.Query) (dsq.Results, error) {
+	if err := d.coalesce.flushPrefix(q.Prefix); err != nil {
+		return nil, err
+	}
+	return d.rawQuery(context.Background(), d.db, q, nil)
+}
+
+func (d *Datastore) rawQuery(ctx context.Context, db querier, q dsq.Query, stats *QueryStats) (dsq.Results, error) {
+	q = d.normalizeQuery(q)
+	d.advisor.observe(q.Prefix)
+	d.seqScans.check(ctx, d, db, q.Prefix)
+	rows, err := d.queryRows(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries, err := scanEntries(rows, columnsOf(q), d.maxScanBytes)
+	if err != nil {
+		return nil, err
+	}
+	if stats != nil {
+		stats.RowsScanned = len(entries)
+	}
+
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+// queryRows runs the SQL for q's prefix, key order, limit and offset.
+func (d *Datastore) queryRows(ctx context.Context, db querier, q dsq.Query) (*sql.Rows, error) {
+	if err := validateQuery(q); err != nil {
+		return nil, err
+	}
+
+	return queryWithParams(ctx, db, d.queries, q)
+}
+
+// QueryChan streams the results of q over a channel instead of reading them
+// all into memory first. The channel holds at most the configured buffer
+// size of results; when the consumer falls behind, reading from the database
+// pauses until there is room. Cancelling ctx stops the stream, closes the
+// underlying rows and closes the channel.
+//
+// Filters, limit and offset are applied as results stream. A lone key,
+// descending key or key length order is applied in SQL, as by Query; other
+// orders would need every result in memory, and return ErrUnsupported.
+//
+// The connection serving the query is held until every result has been
+// read from it; see WithEarlyRelease for slow consumers.
+func (d *Datastore) QueryChan(ctx context.Context, q dsq.Query, opts ...QueryOption) (<-chan dsq.Result, error) {
+	if len(q.Orders) > 0 && sqlOrderOf(d.queries, q.Orders) == unordered {
+		return nil, ErrUnsupported
+	}
+	if err := d.coalesce.flushPrefix(q.Prefix); err != nil {
+		return nil, err
+	}
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	q = d.normalizeQuery(q)
+	d.advisor.observe(q.Prefix)
+	d.seqScans.check(ctx, d, d.db, q.Prefix)
+
+	o := queryOptions{buffer: d.queryBufferSize()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	split := splitFilters(q.Prefix, q.Filters)
+	naive := len(split.rest) > 0
+	rq := q
+	rq.Filters = split.pushed
+	if naive {
+		rq.Limit = 0
+		rq.Offset = 0
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.queryRows(ctx, d.db, rq)
+	err = d.poolError(ctxError(ctx, err), waits)
+	// The breaker learns whether the database answered, not how the
+	// consumer fares reading the stream.
+	d.breaker.record(probe, err)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan dsq.Result, o.buffer)
+	d.active.begin()
+	go func() {
+		defer d.active.end()
+		defer close(out)
+		defer rows.Close()
+
+		send := func(r dsq.Result) bool {
+			if !d.active.isStopped() {
+				select {
+				case out <- r:
+					return true
+				case <-ctx.Done():
+					return false
+				case <-d.active.stopped:
+				}
+			}
+			// Close stopped the stream; tell the consumer why it ends.
+			select {
+			case out <- dsq.Result{Error: ErrClosed}:
+			case <-ctx.Done():
+			}
+			return false
+		}
+
+		offset, limit := q.Offset, q.Limit
+		var scanned int64
+		for rows.Next() {
+			e, err := scanEntry(rows, columnsOf(q))
+			if err != nil {
+				send(dsq.Result{Error: err})
+				return
+			}
+
+			if e.Size > 0 {
+				scanned += int64(e.Size)
+			}
+			if d.maxScanBytes > 0 && scanned > d.maxScanBytes {
+				send(dsq.Result{Error: ErrScanBudgetExceeded})
+				return
+			}
+
+			if naive {
+				if !filterEntry(split.rest, e) {
+					continue
+				}
+				if offset > 0 {
+					offset--
+					continue
+				}
+			}
+
+			if !send(dsq.Result{Entry: e}) {
+				return
+			}
+
+			if naive && limit > 0 {
+				limit--
+				if limit == 0 {
+					return
+				}
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			send(dsq.Result{Error: err})
+		}
+	}()
+
+	return out, nil
+}
+
+func filterEntry(filters []dsq.Filter, e dsq.Entry) bool {
+	for _, f := range filters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Datastore) queryBufferSize() int {
+	if d.queryBuffer > 0 {
+		return d.queryBuffer
+	}
+	return defaultQueryBuffer
+}
+
+// scanEntries reads entries from rows, which select cols. On failure, or
+// once the sizes read exceed a nonzero budget, it returns a
+// PartialResultError holding the entries read so far.
+func scanEntries(rows *sql.Rows, cols columns, budget int64) ([]dsq.Entry, error) {
+	var entries []dsq.Entry
+	var scanned int64
+
+	for rows.Next() {
+		entry, err := scanEntry(rows, cols)
+
+		if err != nil {
+			return nil, &PartialResultError{Entries: entries, Err: err}
+		}
+
+		if entry.Size > 0 {
+			scanned += int64(entry.Size)
+		}
+		if budget > 0 && scanned > budget {
+			return nil, &PartialResultError{Entries: entries, Err: ErrScanBudgetExceeded}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, &PartialResultError{Entries: entries, Err: err}
+	}
+
+	return entries, nil
+}
+
+func scanEntry(rows *sql.Rows, cols columns) (dsq.Entry, error) {
+	var e dsq.Entry
+	switch cols {
+	case keyAndSize:
+		err := rows.Scan(&e.Key, &e.Size)
+		return e, err
+	case keyOnly:
+		// The size isn't known without reading the value.
+		e.Size = -1
+		err := rows.Scan(&e.Key)
+		return e, err
+	}
+
+	err := rows.Scan(&e.Key, &e.Value)
+	e.Size = len(e.Value)
+	return e, err
+}
+
+// columns are the columns a query selects.
+type columns int
+
+const (
+	keyAndData columns = iota
+	keyAndSize
+	keyOnly
+)
+
+// columnsOf returns the columns selected to answer q: sizes are computed in
+// SQL when q asks for them without values, and values aren't read when q
+// asks for neither.
+func columnsOf(q dsq.Query) columns {
+	switch {
+	case q.KeysOnly && q.ReturnsSizes:
+		return keyAndSize
+	case q.KeysOnly:
+		return keyOnly
+	}
+	return keyAndData
+}
+
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	return d.GetSizeContext(context.Background(), key)
+}
+
+// GetSizeContext is like GetSize, aborting the statement when ctx is done.
+func (d *Datastore) GetSizeContext(ctx context.Context, key ds.Key) (size int, err error) {
+	if d.recorder != nil {
+		defer func() { d.record(Op{Type: OpGetSize, Key: key.String(), ValueLen: size}, err) }()
+	}
+
+	if v, ok := d.coalesce.get(key.String()); ok {
+		return len(v), nil
+	}
+
+	probe, err := d.breaker.allow()
+	if err != nil {
+		return 0, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	err = d.run(ctx, d.reader(), OpGetSize, func(c dbConn) error {
+		return d.queryRow(ctx, c, d.queries.GetSize(), key.String()).Scan(&size)
+	})
+	err = d.poolError(ctxError(ctx, err), waits)
+	if d.sizeFallback && err != nil && err != sql.ErrNoRows && ctx.Err() == nil && err != ErrPoolExhausted {
+		// The statement failed rather than the connection, so the table
+		// may not support measuring values in SQL, as with a column of an
+		// unexpected type; fetch the value and measure it instead.
+		err = d.run(ctx, d.reader(), OpGetSize, func(c dbConn) error {
+			var value []byte
+			err := d.queryRow(ctx, c, d.queries.Get(), key.String()).Scan(&value)
+			size = len(value)
+			return err
+		})
+		err = d.poolError(ctxError(ctx, err), waits)
+	}
+	d.breaker.record(probe, err)
+
+	switch err {
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		return size, nil
+	default:
+		return 0, keyError("get size", key.String(), err)
+	}
+}
+
+// DeletePrefix deletes every key under prefix and returns the number of keys
+// deleted. The prefix matches like a query's, at a segment boundary unless
+// Options.LegacyPrefixMatching is set.
+func (d *Datastore) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	// Held puts under the prefix must not land after, and undo, the delete.
+	if err := d.coalesce.flushPrefix(prefix); err != nil {
+		return 0, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	prefixed := fmt.Sprintf("prefix %q", prefix)
+	result, err := d.db.ExecContext(ctx, d.queries.DeletePrefix(), likePrefix(d.matchPrefix(prefix), d.queries.LikeEscape()))
+	if err != nil {
+		return 0, keysError("delete", prefixed, d.poolError(ctxError(ctx, err), waits))
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, keysError("delete", prefixed, err)
+	}
+	analyzeAfter(d.db, d.queries, n, d.analyzeThreshold)
+	return n, nil
+}
+
+// DeleteMany deletes the given keys and returns the number of keys that
+// existed and were deleted. Missing keys are not an error.
+func (d *Datastore) DeleteMany(ctx context.Context, keys []ds.Key) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if d.queries.DeleteMany() == "" {
+		return 0, ErrUnsupported
+	}
+
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		if err := d.validateKey(k); err != nil {
+			return 0, err
+		}
+		strs[i] = k.String()
+	}
+	// Held puts are written rather than dropped, so that the count
+	// includes them.
+	if err := d.coalesce.flushKeys(strs); err != nil {
+		return 0, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d keys", len(keys))
+	result, err := d.db.ExecContext(ctx, d.queries.DeleteMany(), pq.Array(strs))
+	if err != nil {
+		return 0, keysError("delete", many, d.poolError(ctxError(ctx, err), waits))
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, keysError("delete", many, err)
+	}
+	analyzeAfter(d.db, d.queries, n, d.analyzeThreshold)
+	return n, nil
+}
+
+// analyzeAfter refreshes the planner statistics after a bulk operation that
+// changed at least threshold rows, so later queries are not planned against
+// stale estimates. It is best-effort: the bulk operation has already
+// succeeded, so a failure here is not reported.
+func analyzeAfter(db *sql.DB, queries Queries, rows, threshold int64) {
+	if threshold <= 0 || rows < threshold {
+		return
+	}
+	db.Exec(queries.Analyze())
+}
+
+// likePrefix returns a LIKE pattern matching strings starting with prefix,
+// escaping LIKE wildcards and the escape character itself so they match
+// literally.
+func likePrefix(prefix string, escape rune) string {
+	return likeLiteral(prefix, escape) + "%"
+}
+
+// likeLiteral returns a LIKE pattern matching s exactly.
+func likeLiteral(s string, escape rune) string {
+	e := string(escape)
+	r := strings.NewReplacer(e, e+e, `%`, e+`%`, `_`, e+`_`)
+	return r.Replace(s)
+}
+
+// keyFilters are the filters of a query that restrict keys to a prefix or
+// to a single key, folded with the query's prefix so they can be applied in
+// SQL through the LIKE pattern bound for it.
+type keyFilters struct {
+	// prefix is what every key matched starts with, or, when exact is
+	// set, the only key matched.
+	prefix string
+	exact  bool
+	// pushed are the filters folded into prefix, and rest the others,
+	// which must be applied in Go.
+	pushed []dsq.Filter
+	rest   []dsq.Filter
+}
+
+// splitFilters folds the key prefix filters and key equality filters that
+// narrow prefix into it, leaving any that don't, such as a second differing
+// key, to be applied in Go.
+func splitFilters(prefix string, filters []dsq.Filter) keyFilters {
+	k := keyFilters{prefix: prefix}
+	for _, f := range filters {
+		if k.fold(f) {
+			k.pushed = append(k.pushed, f)
+		} else {
+			k.rest = append(k.rest, f)
+		}
+	}
+	return k
+}
+
+func (k *keyFilters) fold(f dsq.Filter) bool {
+	switch f := f.(type) {
+	case dsq.FilterKeyPrefix:
+		return k.foldPrefix(f.Prefix)
+	case *dsq.FilterKeyPrefix:
+		return k.foldPrefix(f.Prefix)
+	case dsq.FilterKeyCompare:
+		return f.Op == dsq.Equal && k.foldKey(f.Key)
+	case *dsq.FilterKeyCompare:
+		return f.Op == dsq.Equal && k.foldKey(f.Key)
+	}
+	return false
+}
+
+func (k *keyFilters) foldPrefix(prefix string) bool {
+	switch {
+	case strings.HasPrefix(k.prefix, prefix):
+		// Already implied by what is matched.
+		return true
+	case k.exact || !strings.HasPrefix(prefix, k.prefix):
+		return false
+	}
+	k.prefix = prefix
+	return true
+}
+
+func (k *keyFilters) foldKey(key string) bool {
+	if k.exact {
+		return key == k.prefix
+	}
+	if !strings.HasPrefix(key, k.prefix) {
+		return false
+	}
+	k.prefix = key
+	k.exact = true
+	return true
+}
+
+// pattern returns the LIKE pattern matching the keys k allows.
+func (k keyFilters) pattern(escape rune) string {
+	if k.exact {
+		return likeLiteral(k.prefix, escape)
+	}
+	return likePrefix(k.prefix, escape)
+}
+
+// MissingKeys returns the subset of keys that are not present in the
+// datastore, in the order they were given.
+func (d *Datastore) MissingKeys(ctx context.Context, keys []ds.Key) ([]ds.Key, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	found, err := d.HasMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []ds.Key
+	for _, k := range keys {
+		if !found[k.String()] {
+			missing = append(missing, k)
+		}
+	}
+
+	return missing, nil
+}
+
+// SizesMany returns the size of each of the given keys that exists, keyed by
+// the key's string form. Missing keys are omitted from the map.
+func (d *Datastore) SizesMany(ctx context.Context, keys []ds.Key) (map[string]int, error) {
+	sizes := make(map[string]int, len(keys))
+	if len(keys) == 0 {
+		return sizes, nil
+	}
+	if d.queries.SizesMany() == "" {
+		return nil, ErrUnsupported
+	}
+	held := d.heldValues(keys)
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d keys", len(keys))
+	rows, err := d.db.QueryContext(ctx, d.queries.SizesMany(), pq.Array(keyStrings(keys)))
+	if err != nil {
+		return nil, keysError("get size", many, d.poolError(ctxError(ctx, err), waits))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var size int
+		if err := rows.Scan(&key, &size); err != nil {
+			return nil, keysError("get size", many, err)
+		}
+		sizes[key] = size
+	}
+	if err := rows.Err(); err != nil {
+		return nil, keysError("get size", many, ctxError(ctx, err))
+	}
+
+	for k, v := range held {
+		sizes[k] = len(v)
+	}
+	return sizes, nil
+}
+
+// HasMany reports which of the given keys exist, keyed by the key's string
+// form, checking them all in one statement. Missing keys are omitted from
+// the map. The keys are bound as one array, so a single prepared statement
+// serves any number of them.
+func (d *Datastore) HasMany(ctx context.Context, keys []ds.Key) (map[string]bool, error) {
+	found := make(map[string]bool, len(keys))
+	if len(keys) == 0 {
+		return found, nil
+	}
+	if d.queries.ExistingKeys() == "" {
+		return nil, ErrUnsupported
+	}
+	held := d.heldValues(keys)
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d keys", len(keys))
+	rows, err := d.rawRow(ctx, d.db, d.queries.ExistingKeys(), pq.Array(keyStrings(keys)))
+	if err != nil {
+		return nil, keysError("has", many, d.poolError(ctxError(ctx, err), waits))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, keysError("has", many, err)
+		}
+		found[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, keysError("has", many, ctxError(ctx, err))
+	}
+
+	for k := range held {
+		found[k] = true
+	}
+	return found, nil
+}
+
+// GetMany returns the value of each of the given keys that exists, keyed by
+// the key's string form, fetching them all in one statement. Missing keys
+// are omitted from the map. Unlike Get, it doesn't update access times. As
+// with HasMany, one prepared statement serves any number of keys.
+func (d *Datastore) GetMany(ctx context.Context, keys []ds.Key) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	if d.queries.GetMany() == "" {
+		return nil, ErrUnsupported
+	}
+	// Held values are looked up first, so that one flushed meanwhile is
+	// still found by the query.
+	held := d.heldValues(keys)
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d keys", len(keys))
+	rows, err := d.rawRow(ctx, d.reader(), d.queries.GetMany(), pq.Array(keyStrings(keys)))
+	if err != nil {
+		return nil, keysError("get", many, d.poolError(ctxError(ctx, err), waits))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, keysError("get", many, err)
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, keysError("get", many, ctxError(ctx, err))
+	}
+
+	for k, v := range held {
+		values[k] = append([]byte{}, v...)
+	}
+	return values, nil
+}
+
+// heldValues returns the values the coalescer holds for keys, which the
+// caller must not modify.
+func (d *Datastore) heldValues(keys []ds.Key) map[string][]byte {
+	if d.coalesce == nil {
+		return nil
+	}
+	held := make(map[string][]byte)
+	for _, k := range keys {
+		if v, ok := d.coalesce.get(k.String()); ok {
+			held[k.String()] = v
+		}
+	}
+	return held
+}
+
+// Merge writes entries in a single transaction. For keys that already exist,
+// resolve is called with the stored and the new value, and its result is
+// written instead; the transaction holds the existing rows locked in the
+// meantime, so concurrent merges of the same keys resolve one after the
+// other. Keys inserted concurrently by other writers are overwritten. If
+// resolve returns nil or any write fails, nothing is written.
+func (d *Datastore) Merge(ctx context.Context, entries map[string][]byte, resolve func(key string, old, new []byte) []byte) error {
+	mq, ok := d.queries.(MergeQueries)
+	if !ok {
+		return ErrUnsupported
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(entries))
+	for k, v := range entries {
+		if v == nil {
+			return ErrInvalidType
+		}
+		if err := d.validateKey(ds.RawKey(k)); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	// Lock and write in a fixed order, so concurrent merges can't deadlock.
+	sort.Strings(keys)
+	// Held puts are written first, to be resolved against.
+	if err := d.coalesce.flushKeys(keys); err != nil {
+		return err
+	}
+
+	waits := d.db.Stats().WaitCount
+	many := fmt.Sprintf("%d keys", len(keys))
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return keysError("merge", many, d.poolError(ctxError(ctx, err), waits))
+	}
+	defer tx.Rollback()
+
+	existing, err := lockValues(ctx, tx, mq, keys)
+	if err != nil {
+		return keysError("merge", many, ctxError(ctx, err))
+	}
+
+	written := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		value := entries[k]
+		if old, ok := existing[k]; ok {
+			value = resolve(k, old, value)
+			if value == nil {
+				return ErrInvalidType
+			}
+			if bytes.Equal(value, old) {
+				continue
+			}
+		}
+		if _, err := tx.ExecContext(ctx, mq.Upsert(), k, value); err != nil {
+			return keyError("merge", k, ctxError(ctx, err))
+		}
+		written[k] = value
+	}
+
+	if err := tx.Commit(); err != nil {
+		return keysError("merge", many, ctxError(ctx, err))
+	}
+
+	for k, v := range written {
+		if d.negCache != nil {
+			d.negCache.remove(k)
+		}
+		if d.recorder != nil {
+			d.recorder(Op{Type: OpPut, Key: k, ValueLen: len(v), Value: v})
+		}
+	}
+	return nil
+}
+
+func lockValues(ctx context.Context, tx *sql.Tx, mq MergeQueries, keys []string) (map[string][]byte, error) {
+	rows, err := tx.QueryContext(ctx, mq.LockValues(), pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func keyStrings(keys []ds.Key) []string {
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		strs[i] = k.String()
+	}
+	return strs
+}
+
+// Maintenance operations can run for minutes on large tables. Each takes a
+// context: cancelling it makes Postgres abort the running statement through
+// the protocol's cancel request, and the operation returns ctx.Err(). VACUUM
+// FULL, REINDEX and VACUUM all honor cancellation, including while waiting
+// for locks; a cancelled VACUUM FULL or REINDEX leaves the table and its
+// indexes as they were.
+
+// Compact rewrites the table to reclaim the space left behind by deleted
+// rows, rather than waiting for autovacuum to make it reusable.
+//
+// On Postgres this runs VACUUM FULL, which holds an ACCESS EXCLUSIVE lock on
+// the table for its whole duration: every read and write to the datastore
+// blocks until it finishes, and it needs enough free disk for a full copy of
+// the live rows. Run it during maintenance windows only.
+func (d *Datastore) Compact(ctx context.Context) error {
+	return d.maintenance(ctx, d.queries.Compact())
+}
+
+// Reindex rebuilds the table's indexes, e.g. after heavy churn has bloated
+// them. On Postgres it blocks writes to the table while it runs.
+func (d *Datastore) Reindex(ctx context.Context) error {
+	return d.maintenance(ctx, d.queries.Reindex())
+}
+
+// CollectGarbageContext marks the space held by deleted rows as reusable
+// without locking out reads or writes. Unlike Compact, it does not return
+// space to the operating system.
+func (d *Datastore) CollectGarbageContext(ctx context.Context) error {
+	return d.maintenance(ctx, d.queries.Vacuum())
+}
+
+// CollectGarbage implements ds.GCDatastore.
+func (d *Datastore) CollectGarbage() error {
+	return d.CollectGarbageContext(context.Background())
+}
+
+// MergeTrailingSlashes merges rows whose keys differ only by trailing
+// slashes, such as /foo and /foo/, which legacy writers using raw keys may
+// have left as separate rows for the same logical key. The key without
+// the slashes, the form ds.NewKey produces, wins: a slashed row is deleted
+// if that key has a row of its own, and renamed to it otherwise. It runs in
+// a single transaction and returns the number of slashed rows merged.
+func (d *Datastore) MergeTrailingSlashes(ctx context.Context) (int64, error) {
+	// A held put to a slashed key must be merged, not land after the merge.
+	if err := d.coalesce.flush(); err != nil {
+		return 0, err
+	}
+	txn, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, ctxError(ctx, err)
+	}
+	defer txn.Rollback()
+
+	// The pattern has no wildcard to escape, only the slash to match.
+	rows, err := txn.QueryContext(ctx, d.queries.QueryKeysOnly()+d.queries.Prefix(), "%/")
+	if err != nil {
+		return 0, ctxError(ctx, err)
+	}
+	var slashed []string
 	for rows.Next() {
 		var key string
-		var out []byte
-		err := rows.Scan(&key, &out)
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if strings.TrimRight(key, "/") != "" {
+			slashed = append(slashed, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, ctxError(ctx, err)
+	}
 
-		if err != nil {
-			log.Fatal("Error reading rows from query")
+	var cleaned []string
+	for _, key := range slashed {
+		clean := strings.TrimRight(key, "/")
+		var exists bool
+		if err := txn.QueryRowContext(ctx, d.queries.Exists(), clean).Scan(&exists); err != nil {
+			return 0, ctxError(ctx, keyError("has", clean, err))
+		}
+		if !exists {
+			var value []byte
+			if err := txn.QueryRowContext(ctx, d.queries.Get(), key).Scan(&value); err != nil {
+				return 0, ctxError(ctx, keyError("get", key, err))
+			}
+			if _, err := txn.ExecContext(ctx, d.queries.Put(), clean, value); err != nil {
+				return 0, ctxError(ctx, keyError("put", clean, err))
+			}
+			cleaned = append(cleaned, clean)
 		}
+		if _, err := txn.ExecContext(ctx, d.queries.Delete(), key); err != nil {
+			return 0, ctxError(ctx, keyError("delete", key, err))
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, ctxError(ctx, err)
+	}
 
-		entry := dsq.Entry{
-			Key:   key,
-			Value: out,
+	if d.negCache != nil {
+		for _, k := range cleaned {
+			d.negCache.remove(k)
 		}
+	}
+	return int64(len(slashed)), nil
+}
 
-		entries = append(entries, entry)
+// maintenance runs a long-running maintenance statement, reporting
+// cancellation as ctx.Err() rather than the driver's error. Queries return
+// an empty statement for maintenance their database has no need of.
+func (d *Datastore) maintenance(ctx context.Context, stmt string) error {
+	if stmt == "" {
+		return ErrUnsupported
 	}
+	waits := d.db.Stats().WaitCount
+	_, err := d.db.ExecContext(ctx, stmt)
+	if err != nil && ctx.Err() != nil {
+		return d.poolError(ctx.Err(), waits)
+	}
+	return err
+}
 
-	results := dsq.ResultsWithEntries(q, entries)
-	return results, nil
+// DiskUsage returns the bytes used by the table, implementing
+// ds.PersistentDatastore. Postgres reports the table's size on disk,
+// including indexes; other databases report the total size of the values.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return d.DiskUsageContext(context.Background())
 }
 
-func (d *Datastore) GetSize(key ds.Key) (int, error) {
-	row := d.db.QueryRow(d.queries.GetSize(), key.String())
-	var size int
+// DiskUsageContext is like DiskUsage, aborting the statement when ctx is
+// done.
+func (d *Datastore) DiskUsageContext(ctx context.Context) (uint64, error) {
+	stmt := d.queries.TotalSize()
+	if uq, ok := d.queries.(DiskUsageQueries); ok {
+		stmt = uq.DiskUsage()
+	}
 
-	switch err := row.Scan(&size); err {
-	case sql.ErrNoRows:
-		return -1, ds.ErrNotFound
-	case nil:
-		return size, nil
-	default:
-		return 0, err
+	var size int64
+	waits := d.db.Stats().WaitCount
+	if err := d.db.QueryRowContext(ctx, stmt).Scan(&size); err != nil {
+		return 0, d.poolError(ctxError(ctx, err), waits)
+	}
+	return uint64(size), nil
+}
+
+// Bloat returns the table's dead tuple statistics. These come from the
+// database's statistics collector, so they are estimates that lag behind
+// recent activity and reset when statistics are reset.
+func (d *Datastore) Bloat(ctx context.Context) (BloatStats, error) {
+	bq, ok := d.queries.(BloatQueries)
+	if !ok {
+		return BloatStats{}, ErrUnsupported
+	}
+
+	var stats BloatStats
+	waits := d.db.Stats().WaitCount
+	row := d.db.QueryRowContext(ctx, bq.Bloat())
+	if err := row.Scan(&stats.LiveTuples, &stats.DeadTuples); err != nil {
+		return BloatStats{}, d.poolError(err, waits)
+	}
+
+	if stats.LiveTuples > 0 {
+		stats.DeadRatio = float64(stats.DeadTuples) / float64(stats.LiveTuples)
+	}
+	return stats, nil
+}
+
+// QueryCreatedBetween returns the entries created in [start, end), oldest
+// first. It requires the table to have been created with timestamps enabled.
+func (d *Datastore) QueryCreatedBetween(ctx context.Context, start, end time.Time) (dsq.Results, error) {
+	tq, ok := d.queries.(TimestampQueries)
+	if !ok || tq.CreatedBetween() == "" {
+		return nil, ErrUnsupported
+	}
+	if err := d.coalesce.flush(); err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, tq.CreatedBetween(), start, end)
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	entries, err := scanEntries(rows, keyAndData, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return dsq.ResultsWithEntries(dsq.Query{}, entries), nil
+}
+
+// ExpiringBefore returns up to limit entries that are still live but expire
+// at or before t, soonest first, with their Expiration set, so they can be
+// refreshed before they lapse. It requires the table to have been created
+// with TTL enabled.
+func (d *Datastore) ExpiringBefore(ctx context.Context, t time.Time, limit int) ([]dsq.Entry, error) {
+	tq, ok := d.queries.(TTLQueries)
+	if !ok || tq.ExpiringBefore() == "" {
+		return nil, ErrUnsupported
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit %d must be positive", ErrInvalidQuery, limit)
+	}
+	if err := d.coalesce.flush(); err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, tq.ExpiringBefore(), t, limit)
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var entries []dsq.Entry
+	for rows.Next() {
+		var e dsq.Entry
+		if err := rows.Scan(&e.Key, &e.Value, &e.Expiration); err != nil {
+			return nil, err
+		}
+		e.Size = len(e.Value)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	return entries, nil
+}
+
+// Events returns up to limit entries inserted after the one at afterSeq, in
+// insertion order. Passing the Seq of the last event returned as the next
+// afterSeq pages through the table without gaps or duplicates, even while
+// entries are being appended; start from 0.
+func (d *Datastore) Events(ctx context.Context, afterSeq int64, limit int) ([]Event, error) {
+	sq, ok := d.queries.(SeqQueries)
+	if !ok || sq.Events() == "" {
+		return nil, ErrUnsupported
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit %d must be positive", ErrInvalidQuery, limit)
+	}
+	if err := d.coalesce.flush(); err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, sq.Events(), afterSeq, limit)
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Seq, &e.Entry.Key, &e.Entry.Value); err != nil {
+			return nil, err
+		}
+		e.Entry.Size = len(e.Entry.Value)
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	return events, nil
+}
+
+// DistinctValues groups the entries under prefix by value, returning each
+// distinct value's hash and the number of keys sharing it, most shared first.
+// Like Query, prefix matches whole key segments, so "/foo" doesn't reach
+// "/foobar" unless LegacyPrefixMatching is set.
+func (d *Datastore) DistinctValues(ctx context.Context, prefix string) ([]ValueGroup, error) {
+	vq, ok := d.queries.(ValueGroupQueries)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	if err := d.coalesce.flushPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, vq.DistinctValues(), likePrefix(d.matchPrefix(prefix), d.queries.LikeEscape()))
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var groups []ValueGroup
+	for rows.Next() {
+		var g ValueGroup
+		if err := rows.Scan(&g.Hash, &g.Count); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// FindOrphanLObjects returns the OIDs of large objects the datastore
+// created that no row of the table references, such as those made for the
+// rows of an import skipping existing keys, or left behind by statements
+// bypassing the table's trigger. Only the objects tracked in the
+// <table>_lobjects table are considered, so other large objects in the
+// database are never reported.
+func (d *Datastore) FindOrphanLObjects(ctx context.Context) ([]uint32, error) {
+	lq, ok := d.queries.(LargeObjectQueries)
+	if !ok || lq.OrphanLargeObjects() == "" {
+		return nil, ErrUnsupported
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, lq.OrphanLargeObjects())
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var oids []uint32
+	for rows.Next() {
+		var oid uint32
+		if err := rows.Scan(&oid); err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return oids, nil
+}
+
+// CleanOrphanLObjects unlinks the large objects FindOrphanLObjects would
+// return and reports how many were removed. Objects are tracked in the
+// transaction writing them, so those of writes still in flight are left
+// alone.
+func (d *Datastore) CleanOrphanLObjects(ctx context.Context) (int, error) {
+	lq, ok := d.queries.(LargeObjectQueries)
+	if !ok || lq.UnlinkOrphanLargeObjects() == "" {
+		return 0, ErrUnsupported
+	}
+
+	var n int
+	waits := d.db.Stats().WaitCount
+	if err := d.db.QueryRowContext(ctx, lq.UnlinkOrphanLargeObjects()).Scan(&n); err != nil {
+		return 0, d.poolError(err, waits)
+	}
+	return n, nil
+}
+
+// VerifyIndexUsage reports whether the planner would use an index, rather
+// than scanning the whole table, to answer a prefix query for prefix. The
+// answer depends on the table's statistics, so run it after ANALYZE on a
+// representative table.
+func (d *Datastore) VerifyIndexUsage(ctx context.Context, prefix string) (bool, error) {
+	return d.indexUsed(ctx, d.db, prefix)
+}
+
+// indexUsed is VerifyIndexUsage explaining the query on db.
+func (d *Datastore) indexUsed(ctx context.Context, db querier, prefix string) (bool, error) {
+	eq, ok := d.queries.(ExplainQueries)
+	if !ok {
+		return false, ErrUnsupported
+	}
+
+	stmt, args, err := buildQuery(d.queries, dsq.Query{Prefix: prefix})
+	if err != nil {
+		return false, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := db.QueryContext(ctx, eq.Explain(stmt), args...)
+	if err != nil {
+		return false, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var out []byte
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+		return false, sql.ErrNoRows
+	}
+	if err := rows.Scan(&out); err != nil {
+		return false, err
+	}
+
+	var plans []struct {
+		Plan planNode
+	}
+	if err := json.Unmarshal(out, &plans); err != nil {
+		return false, err
+	}
+	for _, p := range plans {
+		if p.Plan.usesIndex() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// planNode is a node of a JSON query plan.
+type planNode struct {
+	NodeType string     `json:"Node Type"`
+	Plans    []planNode `json:"Plans"`
+}
+
+// usesIndex reports whether n or any node below it reads an index.
+func (n planNode) usesIndex() bool {
+	if strings.Contains(n.NodeType, "Index") {
+		return true
+	}
+	for _, c := range n.Plans {
+		if c.usesIndex() {
+			return true
+		}
+	}
+	return false
+}
+
+// NonEmptyPrefixes returns the distinct key paths under the base prefix
+// under, truncated to at most depth segments below it, in key order. Every
+// returned path is a key or the prefix of at least one key, so a tree can be
+// expanded level by level without visiting empty branches.
+func (d *Datastore) NonEmptyPrefixes(ctx context.Context, under string, depth int) ([]string, error) {
+	prefixQueries, ok := d.queries.(PrefixQueries)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	if depth <= 0 {
+		return nil, fmt.Errorf("%w: depth %d must be positive", ErrInvalidQuery, depth)
+	}
+	if err := d.coalesce.flushPrefix(under); err != nil {
+		return nil, err
+	}
+
+	base := ds.NewKey(under).String()
+	if base != "/" {
+		base += "/"
+	}
+
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, prefixQueries.NonEmptyPrefixes(), likePrefix(base, d.queries.LikeEscape()), utf8.RuneCountInString(base)+1, depth)
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	defer rows.Close()
+
+	var prefixes []string
+	for rows.Next() {
+		var rel string
+		if err := rows.Scan(&rel); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, base+rel)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// KeyResult is a key streamed by AllKeys, or the error ending the stream.
+type KeyResult struct {
+	Key   ds.Key
+	Error error
+}
+
+// AllKeys streams every key in the table through a server-side cursor, so
+// memory use stays bounded however large the table is. The channel is closed
+// once all keys have been sent, or early if ctx is cancelled. A fetch
+// failing partway, or Close stopping the stream, sends a final result with
+// the error first, so a truncated stream can't pass for a complete one. The
+// cursor and its transaction are released either way.
+func (d *Datastore) AllKeys(ctx context.Context) (<-chan KeyResult, error) {
+	cq, ok := d.queries.(CursorQueries)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	const cursor = "sqlds_all_keys"
+	if err := d.coalesce.flush(); err != nil {
+		return nil, err
+	}
+
+	waits := d.db.Stats().WaitCount
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, d.poolError(err, waits)
+	}
+	if _, err := tx.ExecContext(ctx, cq.DeclareKeysCursor(cursor)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	out := make(chan KeyResult, d.queryBufferSize())
+	d.active.begin()
+	go func() {
+		defer d.active.end()
+		defer close(out)
+		// Rolling back closes the cursor as well; an explicit close first
+		// frees it promptly even if the rollback is delayed.
+		defer tx.Rollback()
+		defer tx.ExecContext(context.Background(), cq.CloseCursor(cursor))
+
+		send := func(r KeyResult) bool {
+			if !d.active.isStopped() {
+				select {
+				case out <- r:
+					return true
+				case <-ctx.Done():
+					return false
+				case <-d.active.stopped:
+				}
+			}
+			// Close stopped the stream; tell the consumer why it ends.
+			select {
+			case out <- KeyResult{Error: ErrClosed}:
+			case <-ctx.Done():
+			}
+			return false
+		}
+
+		for {
+			rows, err := tx.QueryContext(ctx, cq.FetchCursor(cursor, keysCursorFetch))
+			if err != nil {
+				send(KeyResult{Error: ctxError(ctx, err)})
+				return
+			}
+
+			n := 0
+			for rows.Next() {
+				var key string
+				if err := rows.Scan(&key); err != nil {
+					rows.Close()
+					send(KeyResult{Error: err})
+					return
+				}
+				n++
+
+				if !send(KeyResult{Key: ds.RawKey(key)}) {
+					rows.Close()
+					return
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				send(KeyResult{Error: ctxError(ctx, err)})
+				return
+			}
+			if n < keysCursorFetch {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// selfTestPrefix namespaces the sentinel keys written by SelfTest.
+const selfTestPrefix = "/.sqlds-selftest/"
+
+// SelfTest checks that the datastore works end to end: it writes a sentinel
+// key, reads it back, finds it with a prefix query and deletes it. Unlike a
+// ping, it fails when the table is missing or not writable.
+func (d *Datastore) SelfTest(ctx context.Context) error {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	key := ds.NewKey(selfTestPrefix + hex.EncodeToString(buf))
+	value := []byte("sqlds self-test " + key.String())
+
+	if _, err := d.db.ExecContext(ctx, d.queries.Put(), key.String(), value); err != nil {
+		return fmt.Errorf("self-test put: %w", err)
+	}
+
+	// Remove the sentinel even if a later step fails.
+	deleted := false
+	defer func() {
+		if !deleted {
+			d.db.ExecContext(context.Background(), d.queries.Delete(), key.String())
+		}
+	}()
+
+	var out []byte
+	if err := d.db.QueryRowContext(ctx, d.queries.Get(), key.String()).Scan(&out); err != nil {
+		return fmt.Errorf("self-test get: %w", err)
+	}
+	if !bytes.Equal(out, value) {
+		return errors.New("self-test get: value read back differs from value written")
+	}
+
+	rs, err := d.query(ctx, d.db, dsq.Query{
+		Prefix:  selfTestPrefix,
+		Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: key.String()}},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("self-test query: %w", err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		return fmt.Errorf("self-test query: %w", err)
+	}
+	if len(entries) != 1 || entries[0].Key != key.String() {
+		return fmt.Errorf("self-test query: expected only %s, got %d entries", key, len(entries))
+	}
+
+	result, err := d.db.ExecContext(ctx, d.queries.Delete(), key.String())
+	if err != nil {
+		return fmt.Errorf("self-test delete: %w", err)
 	}
+	deleted = true
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return fmt.Errorf("self-test delete: expected 1 row deleted, got %d (%v)", n, err)
+	}
+
+	return nil
 }
 
 // Sync guarantees that any Put or Delete calls under prefix that returned
@@ -272,29 +3006,179 @@ func (d *Datastore) GetSize(key ds.Key) (int, error) {
 // satisfy these requirements then Sync may be a no-op.
 //
 // If the prefix fails to Sync this method returns an error.
-func (*Datastore) Sync(prefix ds.Key) error {
-	// For SQL, sync is a no-op.
-	return nil
+func (d *Datastore) Sync(prefix ds.Key) error {
+	// Writes are durable once they return, except those held for
+	// coalescing.
+	return d.coalesce.flushPrefix(prefix.String())
 }
 
 // QueryWithParams applies prefix, limit, and offset params in pg query
 func QueryWithParams(d *Datastore, q dsq.Query) (*sql.Rows, error) {
-	var qNew = d.queries.Query()
+	return queryWithParams(context.Background(), d.db, d.queries, d.normalizeQuery(q))
+}
+
+// normalizeQuery makes q's prefix match whole key segments, unless legacy
+// prefix matching is configured.
+func (d *Datastore) normalizeQuery(q dsq.Query) dsq.Query {
+	q.Prefix = d.matchPrefix(q.Prefix)
+	return q
+}
+
+// matchPrefix returns the string prefix of the keys prefix matches, as
+// normalizeQuery does for queries.
+func (d *Datastore) matchPrefix(prefix string) string {
+	if d.legacyPrefixes {
+		return prefix
+	}
+	return normalizePrefix(prefix)
+}
+
+// normalizePrefix returns the string prefix of the keys below the key
+// prefix: "/foo" and "/foo/" both become "/foo/", which matches "/foo/bar"
+// but not "/foobar". The root prefix "/" becomes "", matching every key.
+func normalizePrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+func queryWithParams(ctx context.Context, db querier, queries Queries, q dsq.Query) (*sql.Rows, error) {
+	qNew, args, err := buildQuery(queries, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.QueryContext(ctx, qNew, args...)
+}
+
+// buildQuery returns the statement for q's prefix, key filters, limit and
+// offset, and the arguments it binds. Filters splitFilters leaves for Go
+// are ignored. Each clause is optional, and they are always emitted
+// in the order SQL requires: WHERE, ORDER BY, LIMIT, then OFFSET. Offset
+// without limit is valid. The prefix is bound as a parameter with its LIKE
+// wildcards escaped, so it only ever matches literally.
+func buildQuery(queries Queries, q dsq.Query) (string, []interface{}, error) {
+	if err := validateQuery(q); err != nil {
+		return "", nil, err
+	}
+
+	var qNew = queries.Query()
+	switch columnsOf(q) {
+	case keyAndSize:
+		qNew = queries.QuerySizes()
+	case keyOnly:
+		qNew = queries.QueryKeysOnly()
+	}
 
-	if q.Prefix != "" {
-		qNew += fmt.Sprintf(d.queries.Prefix(), q.Prefix)
+	order := sqlOrderOf(queries, q.Orders)
+	split := splitFilters(q.Prefix, q.Filters)
+	var args []interface{}
+	if split.prefix != "" || split.exact {
+		switch order {
+		case keyDescending:
+			qNew += queries.(OrderQueries).PrefixDescending()
+		case keyLength:
+			qNew += queries.(KeyLengthQueries).PrefixByKeyLength()
+		default:
+			qNew += queries.Prefix()
+		}
+		args = append(args, split.pattern(queries.LikeEscape()))
+	} else if order == keyLength {
+		qNew += queries.(KeyLengthQueries).OrderByKeyLength()
+	} else if oq, ok := queries.(OrderQueries); ok && (order != unordered || q.Limit != 0 || q.Offset != 0) {
+		// Pages of an unprefixed query are taken in key order, like those
+		// of a prefixed one, so consecutive pages don't overlap.
+		if order == keyDescending {
+			qNew += oq.OrderByKeyDescending()
+		} else {
+			qNew += oq.OrderByKey()
+		}
 	}
 
 	if q.Limit != 0 {
-		qNew += fmt.Sprintf(d.queries.Limit(), q.Limit)
+		qNew += fmt.Sprintf(queries.Limit(), q.Limit)
 	}
 
 	if q.Offset != 0 {
-		qNew += fmt.Sprintf(d.queries.Offset(), q.Offset)
+		if nl, ok := queries.(NoLimitQueries); ok && q.Limit == 0 {
+			qNew += nl.NoLimit()
+		}
+		qNew += fmt.Sprintf(queries.Offset(), q.Offset)
+	}
+
+	return qNew, args, nil
+}
+
+// sqlOrder is an order of query results applied in SQL.
+type sqlOrder int
+
+const (
+	unordered sqlOrder = iota
+	keyAscending
+	keyDescending
+	keyLength
+)
+
+// sqlOrderOf returns the order queries can apply in SQL for orders, or
+// unordered if they must be applied in Go.
+func sqlOrderOf(queries Queries, orders []dsq.Order) sqlOrder {
+	if len(orders) != 1 {
+		return unordered
+	}
+	_, byKey := queries.(OrderQueries)
+	_, byLength := queries.(KeyLengthQueries)
+	switch orders[0].(type) {
+	case dsq.OrderByKey, *dsq.OrderByKey:
+		if byKey {
+			return keyAscending
+		}
+	case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
+		if byKey {
+			return keyDescending
+		}
+	case OrderByKeyLength, *OrderByKeyLength:
+		if byLength {
+			return keyLength
+		}
+	}
+	return unordered
+}
+
+// OrderByKeyLength orders results by the number of characters in their
+// keys, then by key. Postgres and SQLite apply it in SQL.
+type OrderByKeyLength struct{}
+
+func (o OrderByKeyLength) Compare(a, b dsq.Entry) int {
+	la, lb := utf8.RuneCountInString(a.Key), utf8.RuneCountInString(b.Key)
+	switch {
+	case la < lb:
+		return -1
+	case la > lb:
+		return 1
 	}
+	return 0
+}
 
-	return d.db.Query(qNew)
+func (o OrderByKeyLength) String() string {
+	return "KEY LENGTH"
+}
 
+func validateQuery(q dsq.Query) error {
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit %d", ErrInvalidQuery, q.Limit)
+	}
+	if q.Offset < 0 {
+		return fmt.Errorf("%w: negative offset %d", ErrInvalidQuery, q.Offset)
+	}
+	return nil
 }
 
 var _ ds.Datastore = (*Datastore)(nil)
+var _ ContextDatastore = (*Datastore)(nil)
+var _ ds.TxnDatastore = (*Datastore)(nil)
+var _ ds.GCDatastore = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+var _ TxBatch = (*batch)(nil)
+var _ ds.Batch = (*SpillBatch)(nil)
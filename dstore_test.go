@@ -3,12 +3,25 @@ package sqlds
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/autobatch"
+	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -147,3 +160,1651 @@ func TestProviderManagerDatastore(t *testing.T) {
 	p.Process().Close()
 
 }
+
+func TestKeyCollation(t *testing.T) {
+	opts := &Options{
+		Table:        "collationtest",
+		KeyCollation: "C",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS collationtest")
+		store.Close()
+	}()
+
+	// Under most locale collations lowercase and uppercase letters are
+	// interleaved and punctuation is ignored, whereas byte order puts
+	// '/' and uppercase letters before lowercase ones.
+	keys := []string{"/c/b", "/c/B", "/c/a", "/c/A", "/c/a/b", "/c/_"}
+	for _, k := range keys {
+		if err := store.Put(datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Limit forces the ordering done by SQL to be observed.
+	rs, err := store.Query(dsq.Query{Prefix: "/c/", Limit: len(keys)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{
+		"/c/A",
+		"/c/B",
+		"/c/_",
+		"/c/a",
+		"/c/a/b",
+		"/c/b",
+	})
+}
+
+func TestCompact(t *testing.T) {
+	opts := &Options{
+		Table: "compacttest",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS compacttest")
+		store.Close()
+	}()
+
+	relationSize := func() int64 {
+		var size int64
+		row := store.db.QueryRow("SELECT pg_total_relation_size('compacttest')")
+		if err := row.Scan(&size); err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+
+	value := make([]byte, 1024)
+	count := 2000
+	for i := 0; i < count; i++ {
+		if err := store.Put(datastore.NewKey(fmt.Sprintf("key%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 10; i < count; i++ {
+		if err := store.Delete(datastore.NewKey(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := relationSize()
+	if err := store.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after := relationSize()
+
+	if after >= before {
+		t.Fatalf("expected table to shrink after compaction, %d >= %d", after, before)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := store.Get(datastore.NewKey(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadAfterWritePrimary(t *testing.T) {
+	opts := &Options{
+		Table: "lsntest",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS lsntest")
+		store.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := datastore.NewKey("/lsn")
+	lsn, err := store.PutWithLSN(ctx, key, []byte("written"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn == "" {
+		t.Fatal("expected a non-empty LSN")
+	}
+
+	val, err := store.GetWithOptions(ctx, key, WithMinLSN(lsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "written" {
+		t.Fatalf("got wrong value: %s", val)
+	}
+}
+
+// TestReadAfterWriteReplica requires SQLDS_TEST_REPLICA_DSN to point at a
+// streaming replica of the primary the other tests use.
+func TestReadAfterWriteReplica(t *testing.T) {
+	dsn := os.Getenv("SQLDS_TEST_REPLICA_DSN")
+	if dsn == "" {
+		t.Skip("SQLDS_TEST_REPLICA_DSN not set")
+	}
+
+	opts := &Options{
+		Table: "lsnreplicatest",
+	}
+	primary, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		primary.db.Exec("DROP TABLE IF EXISTS lsnreplicatest")
+		primary.Close()
+	}()
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := NewDatastore(db, NewQueriesForTable(opts.Table))
+	defer replica.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := 0; i < 100; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/lsn/%d", i))
+		lsn, err := primary.PutWithLSN(ctx, key, []byte("replicated"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Without waiting, the replica may not have the row yet.
+		val, err := replica.GetWithOptions(ctx, key, WithMinLSN(lsn))
+		if err != nil {
+			t.Fatalf("key %s not visible on replica after waiting for %s: %s", key, lsn, err)
+		}
+		if string(val) != "replicated" {
+			t.Fatalf("got wrong value: %s", val)
+		}
+	}
+}
+
+func TestSkipEmptyValues(t *testing.T) {
+	opts := &Options{
+		Table:           "skipemptytest",
+		SkipEmptyValues: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS skipemptytest")
+		store.Close()
+	}()
+
+	entries := map[string]string{
+		"/p/a": "a",
+		"/p/b": "",
+		"/p/c": "c",
+		"/p/d": "",
+		"/q/e": "e",
+	}
+	for k, v := range entries {
+		if err := store.Put(datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := store.Query(dsq.Query{Prefix: "/p/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyFilterMatches(t, rs, []string{"/p/a", "/p/c"})
+
+	// Empty values are still readable directly.
+	if _, err := store.Get(datastore.NewKey("/p/b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetLatestSeq(t *testing.T) {
+	opts := &Options{
+		Table: "seqduptest",
+		Seq:   true,
+	}
+	opts.setDefaults()
+	db, err := sql.Open("postgres", fmt.Sprintf("postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=disable",
+		opts.Database, opts.Host, opts.Port, opts.User, opts.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A legacy table without the unique constraint on key.
+	_, err = db.Exec("CREATE TABLE seqduptest (key TEXT NOT NULL, data BYTEA NOT NULL, seq BIGSERIAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE IF EXISTS seqduptest")
+
+	for _, v := range []string{"old", "new"} {
+		if _, err := db.Exec("INSERT INTO seqduptest (key, data) VALUES ('/dup', $1)", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 5; i++ {
+		val, err := store.Get(datastore.NewKey("/dup"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "new" {
+			t.Fatalf("expected the highest seq value, got %s", val)
+		}
+	}
+
+	size, err := store.GetSize(datastore.NewKey("/dup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("new") {
+		t.Fatalf("expected size of the highest seq value, got %d", size)
+	}
+}
+
+func TestBloat(t *testing.T) {
+	opts := &Options{
+		Table: "bloattest",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS bloattest")
+		store.Close()
+	}()
+
+	// Keep autovacuum from cleaning up the churn before we look at it.
+	if _, err := store.db.Exec("ALTER TABLE bloattest SET (autovacuum_enabled = false)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := store.Put(datastore.NewKey(fmt.Sprintf("key%d", i)), []byte("churn")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 150; i++ {
+		if err := store.Delete(datastore.NewKey(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The statistics collector reports asynchronously.
+	var stats BloatStats
+	for i := 0; i < 50; i++ {
+		stats, err = store.Bloat(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.DeadTuples > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if stats.DeadTuples == 0 {
+		t.Fatalf("expected dead tuples after churn, got %+v", stats)
+	}
+	if stats.LiveTuples > 0 && stats.DeadRatio == 0 {
+		t.Fatalf("expected a nonzero dead ratio, got %+v", stats)
+	}
+}
+
+func TestCreatePostgresContextDeadline(t *testing.T) {
+	// A server that accepts connections but never speaks the protocol.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{
+		Host: host,
+		Port: port,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = opts.CreatePostgresContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("CreatePostgresContext took %s to give up", elapsed)
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	q := NewQueriesForTable("user")
+
+	cases := map[string]string{
+		"kv":      `"kv"`,
+		"select":  `"select"`,
+		"order":   `"order"`,
+		"MixedUp": `"MixedUp"`,
+		`we"ird`:  `"we""ird"`,
+	}
+	for in, expect := range cases {
+		if got := q.QuoteIdent(in); got != expect {
+			t.Errorf("QuoteIdent(%q) = %s, want %s", in, got, expect)
+		}
+	}
+
+	if got := q.Get(); got != `SELECT data FROM "user" WHERE key = $1` {
+		t.Errorf("reserved table name not quoted: %s", got)
+	}
+
+	qualified := NewQueriesForTable("ipfs.kv")
+	if got := qualified.Delete(); got != `DELETE FROM "ipfs"."kv" WHERE key = $1` {
+		t.Errorf("schema-qualified table name not quoted per part: %s", got)
+	}
+}
+
+func TestQueryCreatedBetween(t *testing.T) {
+	opts := &Options{
+		Table:      "createdtest",
+		Timestamps: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS createdtest")
+		store.Close()
+	}()
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("/created/%d", i)
+		if err := store.Put(datastore.NewKey(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		// Backdate each entry to a controlled hour.
+		_, err := store.db.Exec("UPDATE createdtest SET created_at = $1 WHERE key = $2", base.Add(time.Duration(i)*time.Hour), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := store.QueryCreatedBetween(context.Background(), base.Add(2*time.Hour), base.Add(5*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{
+		"/created/2",
+		"/created/3",
+		"/created/4",
+	})
+
+	plain := &Options{Table: "createdtest"}
+	store2, err := plain.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+	if _, err := store2.QueryCreatedBetween(context.Background(), base, base); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported without timestamps enabled, got %v", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	opts := &Options{
+		Table: "eventstest",
+		Seq:   true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS eventstest")
+		store.Close()
+	}()
+
+	// Keys are put out of key order, so seq order is distinguishable.
+	var want []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/event/%d", 9-i)
+		if err := store.Put(datastore.NewKey(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+
+	ctx := context.Background()
+	var got []string
+	var after int64
+	for pages := 0; ; pages++ {
+		events, err := store.Events(ctx, after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 0 {
+			if pages != 4 {
+				t.Fatalf("expected 4 pages, got %d", pages)
+			}
+			break
+		}
+		for _, e := range events {
+			if e.Seq <= after {
+				t.Fatalf("seq %d is not after %d", e.Seq, after)
+			}
+			if string(e.Entry.Value) != e.Entry.Key {
+				t.Fatalf("unexpected value %q for %s", e.Entry.Value, e.Entry.Key)
+			}
+			after = e.Seq
+			got = append(got, e.Entry.Key)
+		}
+
+		// Entries appended mid-consumption show up on later pages.
+		if pages == 1 {
+			key := "/event/late"
+			if err := store.Put(datastore.NewKey(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, key)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	if _, err := store.Events(ctx, 0, 0); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for a zero limit, got %v", err)
+	}
+
+	plain := &Options{Table: "eventstest"}
+	store2, err := plain.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+	if _, err := store2.Events(ctx, 0, 1); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported without seq enabled, got %v", err)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	opts := &Options{
+		Table: "distincttest",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS distincttest")
+		store.Close()
+	}()
+
+	entries := map[string]string{
+		"/v/a":  "shared",
+		"/v/b":  "shared",
+		"/v/c":  "shared",
+		"/v/d":  "pair",
+		"/v/e":  "pair",
+		"/v/f":  "single",
+		"/w/a":  "shared",
+		"/vw/a": "shared",
+	}
+	for k, v := range entries {
+		if err := store.Put(datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := store.DistinctValues(context.Background(), "/v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(v string) string {
+		sum := md5.Sum([]byte(v))
+		return hex.EncodeToString(sum[:])
+	}
+	expect := []ValueGroup{
+		{Hash: hash("shared"), Count: 3},
+		{Hash: hash("pair"), Count: 2},
+		{Hash: hash("single"), Count: 1},
+	}
+	if len(groups) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, groups)
+	}
+	for i := range expect {
+		if groups[i] != expect[i] {
+			t.Errorf("group %d: expected %v, got %v", i, expect[i], groups[i])
+		}
+	}
+}
+
+func TestSkipIdenticalPuts(t *testing.T) {
+	opts := &Options{
+		Table:             "skipidenticaltest",
+		SkipIdenticalPuts: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS skipidenticaltest")
+		store.Close()
+	}()
+
+	key := datastore.NewKey("/same")
+	xmin := func() string {
+		var x string
+		row := store.db.QueryRow("SELECT xmin::text FROM skipidenticaltest WHERE key = $1", key.String())
+		if err := row.Scan(&x); err != nil {
+			t.Fatal(err)
+		}
+		return x
+	}
+
+	if err := store.Put(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	first := xmin()
+
+	if err := store.Put(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if x := xmin(); x != first {
+		t.Fatalf("identical re-put rewrote the row: xmin %s -> %s", first, x)
+	}
+
+	if err := store.Put(key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if x := xmin(); x == first {
+		t.Fatal("changed value did not update the row")
+	}
+	val, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "v2" {
+		t.Fatalf("expected the new value, got %s", val)
+	}
+}
+
+func TestGetAccessed(t *testing.T) {
+	opts := &Options{
+		Table:       "accesstest",
+		AccessTimes: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS accesstest")
+		store.Close()
+	}()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/hot")
+	if _, err := store.GetAccessed(ctx, key); err != datastore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound for a missing key, got %v", err)
+	}
+	if err := store.Put(key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	written, err := store.GetAccessed(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := store.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	read, err := store.GetAccessed(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.After(written) {
+		t.Fatalf("expected Get to advance the access time past %v, got %v", written, read)
+	}
+}
+
+func TestPutWithExpiration(t *testing.T) {
+	opts := &Options{
+		Table: "expiretest",
+		TTL:   true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS expiretest")
+		store.Close()
+	}()
+
+	ctx := context.Background()
+	expiration := func(key datastore.Key) time.Time {
+		var at time.Time
+		row := store.db.QueryRow("SELECT expiration FROM expiretest WHERE key = $1", key.String())
+		if err := row.Scan(&at); err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Microsecond)
+	abs := datastore.NewKey("/absolute")
+	if err := store.PutWithExpireAt(ctx, abs, []byte("v"), deadline); err != nil {
+		t.Fatal(err)
+	}
+	if at := expiration(abs); !at.Equal(deadline) {
+		t.Fatalf("expected expiration %v, got %v", deadline, at)
+	}
+
+	rel := datastore.NewKey("/relative")
+	before := time.Now()
+	if err := store.PutWithTTL(ctx, rel, []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	if at := expiration(rel); at.Before(before.Add(time.Minute).Truncate(time.Microsecond)) || at.After(after.Add(time.Minute)) {
+		t.Fatalf("expected expiration a minute after the put, got %v", at)
+	}
+
+	// Putting again replaces the expiration along with the value.
+	if err := store.PutWithExpireAt(ctx, rel, []byte("v2"), deadline); err != nil {
+		t.Fatal(err)
+	}
+	if at := expiration(rel); !at.Equal(deadline) {
+		t.Fatalf("expected the expiration to be replaced with %v, got %v", deadline, at)
+	}
+}
+
+func TestExpiringBefore(t *testing.T) {
+	opts := &Options{
+		Table: "expiringtest",
+		TTL:   true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS expiringtest")
+		store.Close()
+	}()
+
+	ctx := context.Background()
+	now := time.Now()
+	staggered := []struct {
+		key string
+		in  time.Duration
+	}{
+		{"/later", 3 * time.Hour},
+		{"/expired", -time.Minute},
+		{"/soonest", time.Minute},
+		{"/soon", time.Hour},
+	}
+	for _, s := range staggered {
+		if err := store.PutWithExpireAt(ctx, datastore.NewKey(s.key), []byte(s.key), now.Add(s.in)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put(datastore.NewKey("/forever"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.ExpiringBefore(ctx, now.Add(2*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		if e.Expiration.IsZero() {
+			t.Errorf("%s: expected the expiration to be set", e.Key)
+		}
+	}
+	if strings.Join(keys, ",") != "/soonest,/soon" {
+		t.Fatalf("expected the live entries expiring within two hours, soonest first, got %v", keys)
+	}
+
+	entries, err = store.ExpiringBefore(ctx, now.Add(4*time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/soonest" {
+		t.Fatalf("expected the limit to keep the soonest entry, got %v", entries)
+	}
+}
+
+func TestBatchCommitConflict(t *testing.T) {
+	opts := &Options{Table: "conflicttest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS conflicttest")
+		store.db.Exec("DROP TABLE IF EXISTS conflictallowed")
+		store.Close()
+	}()
+
+	// A deferred foreign key is only checked on commit.
+	for _, stmt := range []string{
+		"CREATE TABLE conflictallowed (key TEXT PRIMARY KEY)",
+		"INSERT INTO conflictallowed VALUES ('/allowed')",
+		"ALTER TABLE conflicttest ADD CONSTRAINT conflicttest_allowed FOREIGN KEY (key) REFERENCES conflictallowed DEFERRABLE INITIALLY DEFERRED",
+	} {
+		if _, err := store.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := store.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/allowed", "/unknown"} {
+		if err := b.Put(datastore.NewKey(k), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = b.Commit()
+	var conflict *ErrConflict
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected an ErrConflict, got %v", err)
+	}
+	if conflict.Key != "/unknown" || conflict.Constraint != "conflicttest_allowed" {
+		t.Fatalf("expected the conflict on /unknown, got %s on %s", conflict.Key, conflict.Constraint)
+	}
+}
+
+func TestMergePut(t *testing.T) {
+	opts := &Options{
+		Table: "mergetest",
+		Merge: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS mergetest")
+		store.Close()
+	}()
+	if !store.queries.(*queries).merge {
+		t.Log("server predates MERGE; testing the fallback")
+	}
+
+	key := datastore.NewKey("/merged")
+	for _, v := range []string{"1", "2"} {
+		if err := store.Put(key, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Fatalf("expected %s after putting it, got %s", v, got)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	opts := &Options{
+		Table:     "verifytest",
+		Checksums: true,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS verifytest")
+		store.Close()
+	}()
+
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := store.Put(datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change /b's value behind the checksum's back, as disk corruption
+	// would.
+	for _, stmt := range []string{
+		"ALTER TABLE verifytest ALTER COLUMN checksum DROP EXPRESSION",
+		"UPDATE verifytest SET data = 'corrupt' WHERE key = '/b'",
+	} {
+		if _, err := store.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reported []string
+	report := func(key string, err error) {
+		reported = append(reported, key)
+	}
+	ctx := context.Background()
+
+	last, err := store.Verify(ctx, "", report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != "/c" || strings.Join(reported, ",") != "/b" {
+		t.Fatalf("expected /b reported and the audit to end at /c, got %v and %s", reported, last)
+	}
+
+	reported = nil
+	if _, err := store.Verify(ctx, "/b", report); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 0 {
+		t.Fatalf("expected resuming after /b to skip it, got %v", reported)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for _, opts := range []*Options{
+		{Table: "castest", Checksums: true},
+		{Table: "castest", Checksums: true, Seq: true},
+	} {
+		testCompareAndSwap(t, opts)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, opts *Options) {
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS castest")
+		store.Close()
+	}()
+	ctx := context.Background()
+
+	hash := func(v string) []byte {
+		sum := sha256.Sum256([]byte(v))
+		return sum[:]
+	}
+	swaps := map[string]func(key datastore.Key, old, new string) (bool, error){
+		"value": func(key datastore.Key, old, new string) (bool, error) {
+			return store.CompareAndSwap(ctx, key, []byte(old), []byte(new))
+		},
+		"hash": func(key datastore.Key, old, new string) (bool, error) {
+			return store.CompareAndSwapHash(ctx, key, hash(old), []byte(new))
+		},
+	}
+	for name, swap := range swaps {
+		key := datastore.NewKey("/" + name)
+		if err := store.Put(key, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := swap(key, "stale", "v2"); err != nil || ok {
+			t.Fatalf("%s: expected a mismatch not to swap, got %v, %v", name, ok, err)
+		}
+		if v, err := store.Get(key); err != nil || string(v) != "v1" {
+			t.Fatalf("%s: expected v1 after a failed swap, got %q, %v", name, v, err)
+		}
+
+		if ok, err := swap(key, "v1", "v2"); err != nil || !ok {
+			t.Fatalf("%s: expected a match to swap, got %v, %v", name, ok, err)
+		}
+		if v, err := store.Get(key); err != nil || string(v) != "v2" {
+			t.Fatalf("%s: expected v2 after swapping, got %q, %v", name, v, err)
+		}
+
+		if ok, err := swap(datastore.NewKey("/missing"), "v1", "v2"); err != nil || ok {
+			t.Fatalf("%s: expected a missing key not to swap, got %v, %v", name, ok, err)
+		}
+	}
+	if opts.Seq {
+		var rows int
+		if err := store.db.QueryRow("SELECT count(*) FROM castest").Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != len(swaps) {
+			t.Fatalf("expected swaps to update rows in place, got %d rows", rows)
+		}
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	opts := &Options{
+		Table:        "maxkeystest",
+		Seq:          true,
+		MaxKeys:      5,
+		ReapInterval: 20 * time.Millisecond,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS maxkeystest")
+		store.Close()
+	}()
+
+	key := func(i int) datastore.Key { return datastore.NewKey(fmt.Sprintf("/k%02d", i)) }
+	for i := 0; i < 12; i++ {
+		if err := store.Put(key(i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		if err := store.db.QueryRow("SELECT count(*) FROM maxkeystest").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 5 {
+			break
+		}
+		if n < 5 || time.Now().After(deadline) {
+			t.Fatalf("expected the reaper to bring the table down to 5 rows, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The newest keys survive.
+	for i := 0; i < 12; i++ {
+		has, err := store.Has(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i >= 7; has != want {
+			t.Errorf("%s: expected present %v, got %v", key(i), want, has)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	opts := &Options{Table: "diskusagetest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS diskusagetest")
+		store.Close()
+	}()
+
+	if err := store.Put(datastore.NewKey("/a"), make([]byte, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := datastore.DiskUsage(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect uint64
+	if err := store.db.QueryRow("SELECT pg_total_relation_size('diskusagetest')").Scan(&expect); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n != expect {
+		t.Fatalf("expected the table's %d bytes, got %d", expect, n)
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	opts := &Options{
+		Table: "allkeystest",
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS allkeystest")
+		store.Close()
+	}()
+
+	// More than one cursor fetch's worth of keys.
+	count := keysCursorFetch*2 + 17
+	_, err = store.db.Exec("INSERT INTO allkeystest (key, data) SELECT '/all/' || i, 'v' FROM generate_series(1, $1) AS i", count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := store.AllKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for r := range ch {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		seen[r.Key.String()] = true
+	}
+	if len(seen) != count {
+		t.Fatalf("expected %d keys, got %d", count, len(seen))
+	}
+	for i := 1; i <= count; i++ {
+		if !seen[fmt.Sprintf("/all/%d", i)] {
+			t.Fatalf("key /all/%d missing", i)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err = store.AllKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		<-ch
+	}
+	cancel()
+
+	deadline := time.After(2 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-ch:
+		case <-deadline:
+			t.Fatal("channel not closed after cancel")
+		}
+	}
+
+	// The cursor's transaction has been released back to the pool.
+	for i := 0; store.db.Stats().InUse > 0; i++ {
+		if i > 100 {
+			t.Fatal("cursor connection still in use after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAnalyzeThreshold(t *testing.T) {
+	opts := &Options{
+		Table:            "analyzetest",
+		AnalyzeThreshold: 100,
+	}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS analyzetest")
+		store.Close()
+	}()
+	if _, err := store.db.Exec("ALTER TABLE analyzetest SET (autovacuum_enabled = false)"); err != nil {
+		t.Fatal(err)
+	}
+
+	lastAnalyze := func() sql.NullTime {
+		var last sql.NullTime
+		row := store.db.QueryRow("SELECT last_analyze FROM pg_stat_user_tables WHERE relname = 'analyzetest'")
+		if err := row.Scan(&last); err != nil {
+			t.Fatal(err)
+		}
+		return last
+	}
+
+	commit := func(n int) {
+		b, err := store.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := b.Put(datastore.NewKey(fmt.Sprintf("/bulk/%d/%d", n, i)), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A small batch stays under the threshold.
+	commit(10)
+	if last := lastAnalyze(); last.Valid {
+		t.Fatalf("did not expect ANALYZE after a small batch, last_analyze = %v", last.Time)
+	}
+
+	commit(200)
+	for i := 0; !lastAnalyze().Valid; i++ {
+		if i > 50 {
+			t.Fatal("expected ANALYZE to have run after a large batch")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestLikeEscape(t *testing.T) {
+	for _, escape := range []rune{0, '!'} {
+		for _, conforming := range []string{"on", "off"} {
+			opts := &Options{Table: "escapetest", LikeEscape: escape}
+			store, err := opts.CreatePostgres()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Pin one connection so the setting applies to every statement.
+			store.db.SetMaxOpenConns(1)
+			if _, err := store.db.Exec("SET standard_conforming_strings = " + conforming); err != nil {
+				t.Fatal(err)
+			}
+
+			keys := []string{`/a!b/1`, `/a!b/2`, `/aXb/1`, `/a\b/1`, `/a\\b/1`, `/aYb/1`}
+			for _, k := range keys {
+				if err := store.Put(datastore.NewKey(k), []byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := context.Background()
+			if n, err := store.DeletePrefix(ctx, "/a!b/"); err != nil || n != 2 {
+				t.Errorf("escape %q, standard_conforming_strings %s: expected 2 deletes for /a!b/, got %d, %v", escape, conforming, n, err)
+			}
+			if n, err := store.DeletePrefix(ctx, `/a\b/`); err != nil || n != 1 {
+				t.Errorf("escape %q, standard_conforming_strings %s: expected 1 delete for /a\\b/, got %d, %v", escape, conforming, n, err)
+			}
+			for _, k := range []string{`/aXb/1`, `/a\\b/1`, `/aYb/1`} {
+				if has, err := store.Has(datastore.NewKey(k)); err != nil || !has {
+					t.Errorf("escape %q, standard_conforming_strings %s: %s should not have been deleted", escape, conforming, k)
+				}
+			}
+
+			store.db.Exec("DROP TABLE IF EXISTS escapetest")
+			store.Close()
+		}
+	}
+}
+
+func TestNonEmptyPrefixes(t *testing.T) {
+	opts := &Options{Table: "prefixestest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS prefixestest")
+		store.Close()
+	}()
+
+	for _, k := range []string{
+		"/tree/a/1/x",
+		"/tree/a/1/y",
+		"/tree/a/2",
+		"/tree/b/3/z/deep",
+		"/tree/c",
+		"/treehouse/a",
+		"/other/a",
+	} {
+		if err := store.Put(datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	cases := []struct {
+		under  string
+		depth  int
+		expect []string
+	}{
+		{"/tree", 1, []string{"/tree/a", "/tree/b", "/tree/c"}},
+		{"/tree", 2, []string{"/tree/a/1", "/tree/a/2", "/tree/b/3", "/tree/c"}},
+		{"/tree/a", 5, []string{"/tree/a/1/x", "/tree/a/1/y", "/tree/a/2"}},
+		{"/", 1, []string{"/other", "/tree", "/treehouse"}},
+		{"/missing", 1, nil},
+	}
+	for _, c := range cases {
+		got, err := store.NonEmptyPrefixes(ctx, c.under, c.depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("NonEmptyPrefixes(%q, %d) = %v, want %v", c.under, c.depth, got, c.expect)
+		}
+	}
+
+	if _, err := store.NonEmptyPrefixes(ctx, "/tree", 0); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for a zero depth, got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	opts := &Options{Table: "mergetest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS mergetest")
+		store.Close()
+	}()
+
+	for k, v := range map[string]string{"/a": "aaaa", "/b": "b", "/c": "cc"} {
+		if err := store.Put(datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var conflicts []string
+	keepLarger := func(key string, old, new []byte) []byte {
+		conflicts = append(conflicts, key)
+		if len(old) >= len(new) {
+			return old
+		}
+		return new
+	}
+	err = store.Merge(context.Background(), map[string][]byte{
+		"/a": []byte("aa"),
+		"/b": []byte("bbbb"),
+		"/d": []byte("d"),
+	}, keepLarger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(conflicts)
+	if strings.Join(conflicts, ",") != "/a,/b" {
+		t.Fatalf("expected the resolver to be called for /a and /b, got %v", conflicts)
+	}
+	for k, v := range map[string]string{"/a": "aaaa", "/b": "bbbb", "/c": "cc", "/d": "d"} {
+		got, err := store.Get(datastore.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+
+	// A failing resolution leaves every key untouched.
+	err = store.Merge(context.Background(), map[string][]byte{
+		"/e": []byte("e"),
+		"/c": []byte("c"),
+	}, func(string, []byte, []byte) []byte { return nil })
+	if err != ErrInvalidType {
+		t.Fatalf("expected ErrInvalidType, got %v", err)
+	}
+	if has, err := store.Has(datastore.NewKey("/e")); err != nil || has {
+		t.Fatal("a failed merge should not write any key")
+	}
+}
+
+func TestVerifyIndexUsage(t *testing.T) {
+	opts := &Options{Table: "indexusagetest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS indexusagetest")
+		store.Close()
+	}()
+
+	_, err = store.db.Exec("INSERT INTO indexusagetest (key, data) SELECT '/k/' || i, 'v' FROM generate_series(1, 20000) AS i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec("ANALYZE indexusagetest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Under the C collation the key's own unique index already serves LIKE
+	// prefixes; otherwise it takes a pattern-ops index.
+	var collate string
+	if err := store.db.QueryRow("SELECT datcollate FROM pg_database WHERE datname = current_database()").Scan(&collate); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if collate != "C" && collate != "POSIX" {
+		used, err := store.VerifyIndexUsage(ctx, "/k/1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used {
+			t.Fatal("expected a sequential scan without a pattern-ops index")
+		}
+	}
+
+	if _, err := store.db.Exec("CREATE INDEX indexusagetest_pattern ON indexusagetest (key text_pattern_ops)"); err != nil {
+		t.Fatal(err)
+	}
+	used, err := store.VerifyIndexUsage(ctx, "/k/1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !used {
+		t.Fatal("expected the pattern-ops index to be used")
+	}
+}
+
+func TestOrphanLObjects(t *testing.T) {
+	opts := &Options{Table: "lotest", LargeObjects: true}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DELETE FROM lotest")
+		store.db.Exec("DROP TABLE IF EXISTS lotest, lotest_lobjects")
+		store.db.Exec("DROP FUNCTION IF EXISTS lotest_store_lo()")
+		store.Close()
+	}()
+
+	ctx := context.Background()
+	key := datastore.NewKey("/lo/ref")
+	if err := store.Put(key, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	var first uint32
+	if err := store.db.QueryRow("SELECT lo FROM lotest WHERE key = '/lo/ref' AND data = ''").Scan(&first); err != nil {
+		t.Fatalf("expected the value in a large object: %v", err)
+	}
+
+	// Overwriting the value replaces its large object.
+	if err := store.Put(key, []byte("referenced")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(key); err != nil || string(v) != "referenced" {
+		t.Fatalf("expected referenced, got %q, %v", v, err)
+	}
+	if size, err := store.GetSize(key); err != nil || size != len("referenced") {
+		t.Fatalf("expected size %d, got %d, %v", len("referenced"), size, err)
+	}
+	var exists bool
+	if err := store.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_largeobject_metadata WHERE oid = $1)", first).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("the overwritten value's large object should have been unlinked")
+	}
+
+	// A tracked large object whose row was never written.
+	var orphan uint32
+	if err := store.db.QueryRow("INSERT INTO lotest_lobjects (oid) SELECT lo_from_bytea(0, 'orphaned') RETURNING oid").Scan(&orphan); err != nil {
+		t.Fatal(err)
+	}
+	// A large object the datastore didn't create.
+	var foreign uint32
+	if err := store.db.QueryRow("SELECT lo_from_bytea(0, 'foreign')").Scan(&foreign); err != nil {
+		t.Fatal(err)
+	}
+	defer store.db.Exec("SELECT lo_unlink($1)", foreign)
+
+	found, err := store.FindOrphanLObjects(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0] != orphan {
+		t.Fatalf("expected orphan %d, got %v", orphan, found)
+	}
+
+	n, err := store.CleanOrphanLObjects(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 large object cleaned, got %d", n)
+	}
+	if found, err := store.FindOrphanLObjects(ctx); err != nil || len(found) != 0 {
+		t.Fatalf("expected no orphans after cleaning, got %v, %v", found, err)
+	}
+
+	if err := store.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_largeobject_metadata WHERE oid = $1)", foreign).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("a large object the datastore didn't create should survive cleaning")
+	}
+	if v, err := store.Get(key); err != nil || string(v) != "referenced" {
+		t.Fatalf("the referenced large object should survive cleaning, got %q, %v", v, err)
+	}
+
+	// Deleting the key unlinks its large object.
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	var tracked int
+	if err := store.db.QueryRow("SELECT count(*) FROM lotest_lobjects").Scan(&tracked); err != nil {
+		t.Fatal(err)
+	}
+	if tracked != 0 {
+		t.Fatalf("expected no tracked large objects after deleting, got %d", tracked)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	cases := []struct {
+		policy  ConflictPolicy
+		written int64
+		err     error
+		expect  map[string]string
+	}{
+		{ConflictSkip, 1, nil, map[string]string{"/a": "old", "/b": "old", "/c": "new"}},
+		{ConflictOverwrite, 2, nil, map[string]string{"/a": "old", "/b": "new", "/c": "new"}},
+		{ConflictError, 0, ErrKeyExists, map[string]string{"/a": "old", "/b": "old"}},
+	}
+
+	for _, c := range cases {
+		opts := &Options{Table: "importtest"}
+		store, err := opts.CreatePostgres()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range []string{"/a", "/b"} {
+			if err := store.Put(datastore.NewKey(k), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := store.Import(context.Background(), []dsq.Entry{
+			{Key: "/b", Value: []byte("stale")},
+			{Key: "/c", Value: []byte("new")},
+			{Key: "/b", Value: []byte("new")},
+		}, ImportOptions{OnConflict: c.policy})
+		if err != c.err {
+			t.Errorf("policy %d: expected error %v, got %v", c.policy, c.err, err)
+		}
+		if n != c.written {
+			t.Errorf("policy %d: expected %d keys written, got %d", c.policy, c.written, n)
+		}
+
+		rs, err := store.Query(dsq.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, e := range entries {
+			got[e.Key] = string(e.Value)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expect) {
+			t.Errorf("policy %d: expected %v, got %v", c.policy, c.expect, got)
+		}
+
+		store.db.Exec("DROP TABLE IF EXISTS importtest")
+		store.Close()
+	}
+}
+
+func TestQueryAnnotated(t *testing.T) {
+	opts := &Options{Table: "annotatedtest", EmptyCheckTTL: time.Nanosecond}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS annotatedtest")
+		store.Close()
+	}()
+	ctx := context.Background()
+
+	check := func(desc string, expectEmpty bool) {
+		rs, err := store.QueryAnnotated(ctx, dsq.Query{Prefix: "/missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s: expected no matches, got %v", desc, entries)
+		}
+		if rs.TableEmpty != expectEmpty {
+			t.Errorf("%s: expected TableEmpty %v, got %v", desc, expectEmpty, rs.TableEmpty)
+		}
+	}
+
+	check("empty table", true)
+	if err := store.Put(datastore.NewKey("/present"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	check("populated table", false)
+}
+
+func TestQueryPrefixLiteral(t *testing.T) {
+	opts := &Options{Table: "prefixliteraltest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS prefixliteraltest")
+		store.Close()
+	}()
+
+	for _, k := range []string{"/a%b/1", "/aXb/1", "/a_b/1", "/it's/1", "/other/1"} {
+		if err := store.Put(datastore.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, expect := range map[string][]string{
+		"/a%b":          {"/a%b/1"},
+		"/a_b":          {"/a_b/1"},
+		"/it's":         {"/it's/1"},
+		"/x' OR '1'='1": nil,
+	} {
+		rs, err := store.Query(dsq.Query{Prefix: prefix, KeysOnly: true})
+		if err != nil {
+			t.Fatalf("%s: %v", prefix, err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Errorf("prefix %q: expected %v, got %v", prefix, expect, got)
+		}
+	}
+}
+
+func TestCopyPostgresToSQLite(t *testing.T) {
+	opts := &Options{Table: "copytest"}
+	src, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		src.db.Exec("DROP TABLE IF EXISTS copytest")
+		src.Close()
+	}()
+
+	expect := map[string]string{}
+	for i := 0; i < 2500; i++ {
+		k := fmt.Sprintf("/copy/%05d", i)
+		expect[k] = "value " + k
+		if err := src.Put(datastore.NewKey(k), []byte(expect[k])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "sqlds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst, err := (&Options{}).CreateSQLite(filepath.Join(dir, "copy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	n, err := src.Copy(context.Background(), dst, CopyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(expect)) {
+		t.Fatalf("expected %d keys copied, got %d", len(expect), n)
+	}
+
+	rs, err := dst.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		got[e.Key] = string(e.Value)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("copied entries differ from the source")
+	}
+}
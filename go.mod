@@ -1,12 +1,14 @@
 module github.com/0xProject/sql-datastore
 
-go 1.13
+go 1.15
 
 require (
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/ipfs/go-cid v0.0.4
 	github.com/ipfs/go-datastore v0.3.1
 	github.com/ipfs/go-ipfs-util v0.0.1
 	github.com/lib/pq v1.2.0
 	github.com/libp2p/go-libp2p-core v0.3.0
 	github.com/libp2p/go-libp2p-kad-dht v0.5.0
+	github.com/mattn/go-sqlite3 v1.14.16
 )
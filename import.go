@@ -0,0 +1,139 @@
+package sqlds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
+)
+
+// ErrKeyExists is returned by Import under ConflictError when an imported
+// key is already stored.
+var ErrKeyExists = errors.New("key already exists")
+
+// ConflictPolicy is what Import does with keys that are already stored.
+type ConflictPolicy int
+
+const (
+	// ConflictSkip keeps the stored value.
+	ConflictSkip ConflictPolicy = iota
+	// ConflictOverwrite replaces the stored value with the imported one.
+	ConflictOverwrite
+	// ConflictError fails the whole import with ErrKeyExists.
+	ConflictError
+)
+
+// ImportOptions configure Import.
+type ImportOptions struct {
+	OnConflict ConflictPolicy
+}
+
+// ImportQueries is implemented by Queries for databases that can bulk load
+// rows into a temporary table with COPY.
+type ImportQueries interface {
+	// CreateImportTable creates a temporary table with ord, key and data
+	// columns, dropped when the transaction ends.
+	CreateImportTable(name string) string
+	// MergeImport writes the rows of the import table into the datastore's
+	// table, resolving conflicts with stored keys by onConflict.
+	MergeImport(name string, onConflict ConflictPolicy) string
+}
+
+// importTable names the temporary table Import copies entries into.
+const importTable = "sqlds_import"
+
+// Import bulk loads entries in a single transaction, copying them into a
+// temporary table and merging that into the datastore's table, which is
+// much faster than putting them one at a time. It returns the number of
+// keys written. If an entry's key appears more than once, its last value is
+// imported.
+func (d *Datastore) Import(ctx context.Context, entries []dsq.Entry, opts ImportOptions) (int64, error) {
+	iq, ok := d.queries.(ImportQueries)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+
+	for _, e := range entries {
+		if e.Value == nil {
+			return 0, ErrInvalidType
+		}
+		if err := d.validateKey(ds.RawKey(e.Key)); err != nil {
+			return 0, err
+		}
+	}
+	// Held puts are written first, so that OnConflict treats their keys as
+	// stored.
+	if err := d.coalesce.flushKeys(entryKeys(entries)); err != nil {
+		return 0, err
+	}
+
+	many := fmt.Sprintf("%d entries", len(entries))
+	fail := func(err error) (int64, error) {
+		return 0, keysError("import", many, ctxError(ctx, err))
+	}
+
+	waits := d.db.Stats().WaitCount
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail(d.poolError(err, waits))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, iq.CreateImportTable(importTable)); err != nil {
+		return fail(err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(importTable, "key", "data"))
+	if err != nil {
+		return fail(err)
+	}
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.Key, e.Value); err != nil {
+			stmt.Close()
+			return fail(err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fail(err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fail(err)
+	}
+
+	result, err := tx.ExecContext(ctx, iq.MergeImport(importTable, opts.OnConflict))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return 0, ErrKeyExists
+		}
+		return fail(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	if d.negCache != nil {
+		for _, e := range entries {
+			d.negCache.remove(e.Key)
+		}
+	}
+	analyzeAfter(d.db, d.queries, n, d.analyzeThreshold)
+	return n, nil
+}
+
+func entryKeys(entries []dsq.Entry) []string {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
@@ -0,0 +1,133 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+)
+
+// mockResponse is what mockDB returns for a statement: rows to iterate, an
+// error to fail iteration with once they run out, and rows affected for
+// Exec.
+type mockResponse struct {
+	columns  []string
+	rows     [][]driver.Value
+	rowsErr  error
+	affected int64
+	// next, if set, generates rows on demand instead of rows; it returns
+	// false when there are no more.
+	next func(dest []driver.Value) bool
+}
+
+// mockDB is an in-process database/sql driver whose statements are answered
+// by handle, for exercising error paths a real database can't easily
+// produce.
+type mockDB struct {
+	mu     sync.Mutex
+	seen   []string
+	handle func(query string, args []driver.Value) (mockResponse, error)
+}
+
+// open returns a *sql.DB backed by m.
+func (m *mockDB) open() *sql.DB {
+	return sql.OpenDB(mockConnector{m})
+}
+
+func (m *mockDB) statements() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.seen...)
+}
+
+func (m *mockDB) run(query string, args []driver.Value) (mockResponse, error) {
+	m.mu.Lock()
+	m.seen = append(m.seen, query)
+	m.mu.Unlock()
+	return m.handle(query, args)
+}
+
+type mockConnector struct{ m *mockDB }
+
+func (c mockConnector) Connect(context.Context) (driver.Conn, error) { return mockConn{c.m}, nil }
+func (c mockConnector) Driver() driver.Driver                        { return mockDriver{c.m} }
+
+type mockDriver struct{ m *mockDB }
+
+func (d mockDriver) Open(string) (driver.Conn, error) { return mockConn{d.m}, nil }
+
+type mockConn struct{ m *mockDB }
+
+func (c mockConn) Prepare(query string) (driver.Stmt, error) { return mockStmt{c.m, query}, nil }
+func (c mockConn) Close() error                              { return nil }
+func (c mockConn) Begin() (driver.Tx, error)                 { return mockTx{c.m}, nil }
+
+// BeginTx accepts transaction options, such as the read-only ones AllKeys
+// asks for, which Begin alone can't.
+func (c mockConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return mockTx{c.m}, nil
+}
+
+// mockTx records COMMIT and ROLLBACK among the statements seen.
+type mockTx struct{ m *mockDB }
+
+func (tx mockTx) Commit() error   { return tx.record("COMMIT") }
+func (tx mockTx) Rollback() error { return tx.record("ROLLBACK") }
+
+func (tx mockTx) record(stmt string) error {
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	tx.m.seen = append(tx.m.seen, stmt)
+	return nil
+}
+
+type mockStmt struct {
+	m     *mockDB
+	query string
+}
+
+func (s mockStmt) Close() error  { return nil }
+func (s mockStmt) NumInput() int { return -1 }
+
+func (s mockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	resp, err := s.m.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(resp.affected), nil
+}
+
+func (s mockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	resp, err := s.m.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &mockRows{resp: resp}, nil
+}
+
+type mockRows struct {
+	resp mockResponse
+	i    int
+}
+
+func (r *mockRows) Columns() []string { return r.resp.columns }
+func (r *mockRows) Close() error      { return nil }
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if r.resp.next != nil {
+		if r.resp.next(dest) {
+			return nil
+		}
+		return io.EOF
+	}
+	if r.i >= len(r.resp.rows) {
+		if r.resp.rowsErr != nil {
+			return r.resp.rowsErr
+		}
+		return io.EOF
+	}
+	copy(dest, r.resp.rows[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,223 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql" //mysql driver
+)
+
+// mysqlQueries are the Queries for a MySQL table. Keys are stored as
+// VARBINARY, so they compare and sort bytewise like keys in postgres under
+// the C collation. MySQL has no array parameters, so the statements taking
+// a list of keys are unsupported.
+type mysqlQueries struct {
+	tableName string
+}
+
+// NewMySQLQueriesForTable returns the Queries for a MySQL table.
+func NewMySQLQueriesForTable(tableName string) Queries {
+	return mysqlQueries{tableName: tableName}
+}
+
+func (q mysqlQueries) Delete() string {
+	return "DELETE FROM " + q.table() + " WHERE `key` = ?"
+}
+
+func (q mysqlQueries) Exists() string {
+	return "SELECT EXISTS(SELECT 1 FROM " + q.table() + " WHERE `key` = ?)"
+}
+
+func (q mysqlQueries) Get() string {
+	return "SELECT data FROM " + q.table() + " WHERE `key` = ?"
+}
+
+func (q mysqlQueries) Put() string {
+	return "INSERT INTO " + q.table() + " (`key`, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)"
+}
+
+func (q mysqlQueries) Query() string {
+	return "SELECT `key`, data FROM " + q.table()
+}
+
+func (q mysqlQueries) QueryKeysOnly() string {
+	return "SELECT `key` FROM " + q.table()
+}
+
+func (q mysqlQueries) QuerySizes() string {
+	return "SELECT `key`, LENGTH(data) FROM " + q.table()
+}
+
+func (q mysqlQueries) TotalSize() string {
+	return "SELECT COALESCE(SUM(LENGTH(data)), 0) FROM " + q.table()
+}
+
+func (q mysqlQueries) Empty() string {
+	return "SELECT NOT EXISTS (SELECT 1 FROM " + q.table() + ")"
+}
+
+// Prefix relies on backslash being MySQL's default LIKE escape character,
+// since declaring it would need escaping differently depending on the
+// server's SQL mode.
+func (q mysqlQueries) Prefix() string {
+	return " WHERE `key` LIKE ? ORDER BY `key`"
+}
+
+func (q mysqlQueries) PrefixDescending() string {
+	return " WHERE `key` LIKE ? ORDER BY `key` DESC"
+}
+
+func (q mysqlQueries) OrderByKey() string {
+	return " ORDER BY `key`"
+}
+
+func (q mysqlQueries) OrderByKeyDescending() string {
+	return " ORDER BY `key` DESC"
+}
+
+func (q mysqlQueries) Limit() string {
+	return ` LIMIT %d`
+}
+
+func (q mysqlQueries) Offset() string {
+	return ` OFFSET %d`
+}
+
+// NoLimit is the largest LIMIT MySQL accepts, which its manual recommends
+// for an offset without a limit.
+func (q mysqlQueries) NoLimit() string {
+	return ` LIMIT 18446744073709551615`
+}
+
+func (q mysqlQueries) GetSize() string {
+	return "SELECT LENGTH(data) FROM " + q.table() + " WHERE `key` = ?"
+}
+
+func (q mysqlQueries) ExistingKeys() string {
+	return ""
+}
+
+func (q mysqlQueries) Compact() string {
+	return `OPTIMIZE TABLE ` + q.table()
+}
+
+// Reindex rebuilds the table, and with it its indexes, in place.
+func (q mysqlQueries) Reindex() string {
+	return `ALTER TABLE ` + q.table() + ` FORCE`
+}
+
+func (q mysqlQueries) Vacuum() string {
+	return `OPTIMIZE TABLE ` + q.table()
+}
+
+func (q mysqlQueries) Analyze() string {
+	return `ANALYZE TABLE ` + q.table()
+}
+
+func (q mysqlQueries) DeletePrefix() string {
+	return "DELETE FROM " + q.table() + " WHERE `key` LIKE ?"
+}
+
+func (q mysqlQueries) DeleteMany() string {
+	return ""
+}
+
+func (q mysqlQueries) SizesMany() string {
+	return ""
+}
+
+func (q mysqlQueries) GetMany() string {
+	return ""
+}
+
+func (q mysqlQueries) LikeEscape() rune {
+	return '\\'
+}
+
+// QuoteIdent quotes a single identifier with backquotes.
+func (q mysqlQueries) QuoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (q mysqlQueries) table() string {
+	return quoteQualified(q.QuoteIdent, q.tableName)
+}
+
+// mysqlMaxKeyBytes is InnoDB's maximum index key length.
+const mysqlMaxKeyBytes = 3072
+
+// mysqlCreateTableSQL returns the statement creating the table. Keys are
+// limited to MaxKeyLength bytes, and to InnoDB's maximum index key length.
+// A key of MaxKeyLength multibyte characters can therefore pass the key
+// length check and still be too long for the column.
+func (opts *Options) mysqlCreateTableSQL() string {
+	table := mysqlQueries{tableName: opts.Table}.table()
+	n := mysqlMaxKeyBytes
+	if opts.MaxKeyLength > 0 && opts.MaxKeyLength < n {
+		n = opts.MaxKeyLength
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARBINARY(%d) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)", table, n)
+}
+
+func (opts *Options) mysqlDSN() string {
+	if opts.ConnectionString != "" {
+		return opts.ConnectionString
+	}
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", opts.User, opts.Password, opts.Host, opts.Port, opts.Database)
+	if params := opts.encodeParams(); params != "" {
+		dsn += "?" + params
+	}
+	return dsn
+}
+
+// CreateMySQL returns a datastore connected to MySQL, creating its table if
+// needed. Host, port and user default to mysql, 3306 and root. The options
+// shaping postgres SQL, such as the feature columns, text values, key
+// collation and read replicas, return ErrUnsupported if set.
+func (opts *Options) CreateMySQL() (*Datastore, error) {
+	return opts.CreateMySQLContext(context.Background())
+}
+
+// CreateMySQLContext is like CreateMySQL, giving up when ctx is done.
+func (opts *Options) CreateMySQLContext(ctx context.Context) (*Datastore, error) {
+	if err := opts.checkPortable("MySQL"); err != nil {
+		return nil, err
+	}
+
+	if opts.Host == "" {
+		opts.Host = "mysql"
+	}
+	if opts.Port == "" {
+		opts.Port = "3306"
+	}
+	if opts.User == "" {
+		opts.User = "root"
+	}
+	opts.setDefaults()
+
+	db, err := sql.Open("mysql", opts.mysqlDSN())
+	if err != nil {
+		return nil, err
+	}
+	opts.configurePool(db)
+
+	if err := pingContext(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, opts.mysqlCreateTableSQL()); err != nil {
+		db.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	d := NewDatastore(db, mysqlQueries{tableName: opts.Table})
+	opts.configure(d)
+	d.connInfo = opts.mysqlConnInfo()
+	return d, nil
+}
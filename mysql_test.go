@@ -0,0 +1,118 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestMySQLCreateTableSQL(t *testing.T) {
+	cases := []struct {
+		maxKeyLength int
+		expect       string
+	}{
+		{0, "CREATE TABLE IF NOT EXISTS `kv` (`key` VARBINARY(3072) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)"},
+		{256, "CREATE TABLE IF NOT EXISTS `kv` (`key` VARBINARY(256) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)"},
+		{10000, "CREATE TABLE IF NOT EXISTS `kv` (`key` VARBINARY(3072) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)"},
+	}
+	for _, c := range cases {
+		opts := &Options{Table: "kv", MaxKeyLength: c.maxKeyLength}
+		if got := opts.mysqlCreateTableSQL(); got != c.expect {
+			t.Errorf("MaxKeyLength %d:\n got: %s\nwant: %s", c.maxKeyLength, got, c.expect)
+		}
+	}
+}
+
+func TestMySQLBuildQuery(t *testing.T) {
+	q := NewMySQLQueriesForTable("kv")
+	const prefixSQL = "SELECT `key`, data FROM `kv` WHERE `key` LIKE ? ORDER BY `key`"
+	cases := []struct {
+		q      dsq.Query
+		expect string
+	}{
+		{dsq.Query{}, "SELECT `key`, data FROM `kv`"},
+		{dsq.Query{Prefix: "/a"}, prefixSQL},
+		{dsq.Query{Prefix: "/a", Limit: 2}, prefixSQL + " LIMIT 2"},
+		// MySQL takes no OFFSET without a LIMIT.
+		{dsq.Query{Prefix: "/a", Offset: 3}, prefixSQL + " LIMIT 18446744073709551615 OFFSET 3"},
+		{dsq.Query{Prefix: "/a", Limit: 2, Offset: 3}, prefixSQL + " LIMIT 2 OFFSET 3"},
+		{dsq.Query{Prefix: "/a", KeysOnly: true, ReturnsSizes: true}, "SELECT `key`, LENGTH(data) FROM `kv` WHERE `key` LIKE ? ORDER BY `key`"},
+		{dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}}, "SELECT `key`, data FROM `kv` ORDER BY `key`"},
+		{dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}}, prefixSQL + " DESC"},
+	}
+	for _, c := range cases {
+		got, _, err := buildQuery(q, c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expect {
+			t.Errorf("%v:\n got: %s\nwant: %s", c.q, got, c.expect)
+		}
+	}
+}
+
+func TestMySQLQuoteIdent(t *testing.T) {
+	q := mysqlQueries{tableName: "app.my`table"}
+	if got := q.table(); got != "`app`.`my``table`" {
+		t.Fatalf("unexpected quoted table: %s", got)
+	}
+}
+
+func TestMySQLRoundTrip(t *testing.T) {
+	// A stand-in for MySQL answering the statements mysqlQueries produces.
+	stored := map[string][]byte{}
+	m := &mockDB{handle: func(query string, args []driver.Value) (mockResponse, error) {
+		q := mysqlQueries{tableName: "kv"}
+		switch query {
+		case q.Put():
+			stored[args[0].(string)] = args[1].([]byte)
+			return mockResponse{affected: 1}, nil
+		case q.Get():
+			v, ok := stored[args[0].(string)]
+			if !ok {
+				return mockResponse{columns: []string{"data"}}, nil
+			}
+			return mockResponse{columns: []string{"data"}, rows: [][]driver.Value{{v}}}, nil
+		case q.Delete():
+			if _, ok := stored[args[0].(string)]; !ok {
+				return mockResponse{}, nil
+			}
+			delete(stored, args[0].(string))
+			return mockResponse{affected: 1}, nil
+		}
+		return mockResponse{}, errors.New("unexpected statement: " + query)
+	}}
+	d := NewDatastore(m.open(), NewMySQLQueriesForTable("kv"))
+	defer d.Close()
+
+	key := ds.NewKey("/a")
+	if err := d.Put(key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(key); err != nil || string(v) != "v" {
+		t.Fatalf("expected v, got %q, %v", v, err)
+	}
+	if err := d.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(key); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	// Statements taking arrays of keys have no MySQL form.
+	if _, err := d.DeleteMany(context.Background(), []ds.Key{key}); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported from DeleteMany, got %v", err)
+	}
+}
+
+func TestCreateMySQLRejectsPostgresOptions(t *testing.T) {
+	for _, opts := range []Options{{Seq: true}, {TextValues: true}, {KeyCollation: "C"}, {ReplicaHost: "replica"}} {
+		if _, err := opts.CreateMySQL(); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%+v: expected ErrUnsupported, got %v", opts, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package sqlds
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// negativeCache is a bounded, expiring set of keys recently found to be
+// absent, used to short-circuit repeated Gets for missing keys.
+type negativeCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List // front is most recently added
+	items map[string]*list.Element
+
+	// lookups holds the keys being looked up in the database, so that a
+	// write invalidating one mid-lookup stops the miss being cached.
+	lookups map[string]*lookup
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// lookup counts the lookups of a key in flight and the removes of it since
+// the first began.
+type lookup struct {
+	n   int
+	gen uint64
+}
+
+func newNegativeCache(size int, ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+		lookups: make(map[string]*lookup),
+	}
+}
+
+// has reports whether key is cached as missing, dropping it if expired.
+func (c *negativeCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(el.Value.(*negativeEntry).expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return false
+	}
+	return true
+}
+
+// begin registers a lookup of key about to query the database, returning
+// the generation to pass to end.
+func (c *negativeCache) begin(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.lookups[key]
+	if !ok {
+		l = &lookup{}
+		c.lookups[key] = l
+	}
+	l.n++
+	return l.gen
+}
+
+// end finishes a lookup begun at gen, recording key as missing if the
+// lookup found it so and key wasn't removed in the meantime: the remove
+// may be for a write the lookup ran too early to see.
+func (c *negativeCache) end(key string, gen uint64, missing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := c.lookups[key]
+	current := l.gen == gen
+	if l.n--; l.n == 0 {
+		delete(c.lookups, key)
+	}
+	if missing && current {
+		c.addLocked(key)
+	}
+}
+
+// add records key as missing, evicting the oldest entry if full.
+func (c *negativeCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(key)
+}
+
+func (c *negativeCache) addLocked(key string) {
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		el.Value.(*negativeEntry).expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&negativeEntry{key: key, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*negativeEntry).key)
+	}
+}
+
+// remove invalidates key, e.g. after it has been written.
+func (c *negativeCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+	if l, ok := c.lookups[key]; ok {
+		l.gen++
+	}
+}
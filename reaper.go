@@ -0,0 +1,112 @@
+package sqlds
+
+import (
+	"context"
+	"time"
+)
+
+// defaultReapInterval is how often the reaper checks the row count when
+// MaxKeys is set without a ReapInterval.
+const defaultReapInterval = time.Minute
+
+// EvictionPolicy picks the rows EnforceMaxKeys deletes first.
+type EvictionPolicy int
+
+const (
+	// EvictOldestWritten deletes the rows first inserted longest ago, by
+	// the seq column.
+	EvictOldestWritten EvictionPolicy = iota
+	// EvictLeastRecentlyRead deletes the rows read longest ago, by the
+	// accessed_at column.
+	EvictLeastRecentlyRead
+)
+
+// EvictQueries is implemented by Queries that can cap the number of rows.
+type EvictQueries interface {
+	// CountRows returns the number of rows in the table.
+	CountRows() string
+	// EvictOldestWritten and EvictLeastRecentlyRead delete as many rows as
+	// the first argument by their policy. They return an empty string when
+	// the table lacks the column the policy orders by.
+	EvictOldestWritten() string
+	EvictLeastRecentlyRead() string
+}
+
+// reaper runs EnforceMaxKeys every interval until stopped.
+type reaper struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startReaper(d *Datastore, interval time.Duration) *reaper {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &reaper{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if _, err := d.EnforceMaxKeys(ctx); err != nil && ctx.Err() == nil {
+					d.logf("sqlds: enforcing the key cap: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// close stops the reaper, cancelling a pass in progress and waiting for it
+// to return.
+func (r *reaper) close() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// EnforceMaxKeys deletes the rows in excess of Options.MaxKeys, evicting
+// them by Options.EvictBy, and returns how many it deleted. The reaper
+// calls it in the background; call it directly to apply the cap at once.
+// Rows written while it runs may leave the table briefly over the cap.
+func (d *Datastore) EnforceMaxKeys(ctx context.Context) (int64, error) {
+	stmt := d.evictStmt()
+	if d.maxKeys <= 0 || stmt == "" {
+		return 0, ErrUnsupported
+	}
+	eq := d.queries.(EvictQueries)
+
+	waits := d.db.Stats().WaitCount
+	var count int64
+	if err := d.db.QueryRowContext(ctx, eq.CountRows()).Scan(&count); err != nil {
+		return 0, d.poolError(ctxError(ctx, err), waits)
+	}
+	if count <= d.maxKeys {
+		return 0, nil
+	}
+
+	result, err := d.db.ExecContext(ctx, stmt, count-d.maxKeys)
+	if err != nil {
+		return 0, d.poolError(ctxError(ctx, err), waits)
+	}
+	n, err := result.RowsAffected()
+	analyzeAfter(d.db, d.queries, n, d.analyzeThreshold)
+	return n, err
+}
+
+// evictStmt returns the statement evicting rows by the configured policy,
+// or "" if the queries can't.
+func (d *Datastore) evictStmt() string {
+	eq, ok := d.queries.(EvictQueries)
+	if !ok {
+		return ""
+	}
+	if d.evictBy == EvictLeastRecentlyRead {
+		return eq.EvictLeastRecentlyRead()
+	}
+	return eq.EvictOldestWritten()
+}
@@ -0,0 +1,104 @@
+package sqlds
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Operation types recorded in Op.Type.
+const (
+	OpGet     = "get"
+	OpHas     = "has"
+	OpGetSize = "getsize"
+	OpPut     = "put"
+	OpDelete  = "delete"
+)
+
+// Op is a recorded datastore operation. Writes made in a batch or
+// transaction are recorded when it commits.
+type Op struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// ValueLen is the length of the value written or read, or the size
+	// returned by GetSize.
+	ValueLen int `json:"value_len"`
+	// Value is the value of a put, so that it can be replayed.
+	Value []byte `json:"value,omitempty"`
+	// Err is the error the operation returned, if any.
+	Err string `json:"err,omitempty"`
+}
+
+// JSONRecorder returns a recorder, for Options.Recorder, writing each
+// operation to w as a line of JSON. It is safe for concurrent use; write
+// errors are ignored.
+func JSONRecorder(w io.Writer) func(Op) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(op Op) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(op)
+	}
+}
+
+// Replay re-applies the successful puts and deletes read from r, as written
+// by JSONRecorder, to dst in order. Reads and failed operations are skipped.
+func Replay(dst ds.Datastore, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var op Op
+		if err := dec.Decode(&op); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if op.Err != "" {
+			continue
+		}
+
+		switch op.Type {
+		case OpPut:
+			if op.Value == nil {
+				op.Value = []byte{}
+			}
+			if err := dst.Put(ds.RawKey(op.Key), op.Value); err != nil {
+				return err
+			}
+		case OpDelete:
+			if err := dst.Delete(ds.RawKey(op.Key)); err != nil && err != ds.ErrNotFound {
+				return err
+			}
+		}
+	}
+}
+
+// OpTiming splits the latency of a single-key operation into the time it
+// waited for a pooled connection and the time it spent executing on it, to
+// tell pool contention apart from slow statements.
+type OpTiming struct {
+	// Type is one of the Op types, such as OpGet.
+	Type    string
+	Acquire time.Duration
+	Exec    time.Duration
+}
+
+// recordTiming adds t to the acquire and exec totals in Stats and passes it
+// to the configured Timings callback.
+func (d *Datastore) recordTiming(t OpTiming) {
+	atomic.AddInt64((*int64)(&d.stats.AcquireTime), int64(t.Acquire))
+	atomic.AddInt64((*int64)(&d.stats.ExecTime), int64(t.Exec))
+	d.timings(t)
+}
+
+// record passes op, with the outcome err, to the configured recorder.
+func (d *Datastore) record(op Op, err error) {
+	if err != nil {
+		op.Err = err.Error()
+	}
+	d.recorder(op)
+}
@@ -0,0 +1,371 @@
+package sqlds
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrSchemaMismatch is returned when an existing table doesn't match the
+// options it is opened with, such as a data column of the wrong type.
+var ErrSchemaMismatch = errors.New("table schema does not match options")
+
+// column is a table column and the DDL type that defines it.
+type column struct {
+	name string
+	def  string
+}
+
+// columns returns the table's columns for the features enabled in opts. The
+// key and data columns always come first; optional feature columns follow in
+// a fixed order so every combination produces a consistent schema.
+func (opts *Options) columns() []column {
+	cols := []column{
+		{opts.keyColumn(), opts.keyDef()},
+		{opts.dataColumn(), opts.dataDef()},
+	}
+
+	if opts.Seq {
+		cols = append(cols, column{"seq", "BIGSERIAL"})
+	}
+	if opts.Timestamps {
+		cols = append(cols, column{"created_at", "TIMESTAMPTZ NOT NULL DEFAULT now()"})
+	}
+	if opts.TTL {
+		cols = append(cols, column{"expiration", "TIMESTAMPTZ"})
+	}
+	if opts.AccessTimes {
+		cols = append(cols, column{"accessed_at", "TIMESTAMPTZ NOT NULL DEFAULT now()"})
+	}
+	if opts.LargeObjects {
+		cols = append(cols, column{"lo", "OID"})
+	}
+	if opts.Checksums {
+		data := opts.dataColumn()
+		if opts.TextValues {
+			data = "convert_to(" + data + ", 'UTF8')"
+		}
+		cols = append(cols, column{"checksum", "BYTEA GENERATED ALWAYS AS (sha256(" + data + ")) STORED"})
+	}
+
+	return cols
+}
+
+func (opts *Options) keyDef() string {
+	if opts.MaxKeyLength > 0 {
+		return fmt.Sprintf("VARCHAR(%d) NOT NULL UNIQUE", opts.MaxKeyLength)
+	}
+	return "TEXT NOT NULL UNIQUE"
+}
+
+func (opts *Options) dataDef() string {
+	if opts.TextValues {
+		return "TEXT NOT NULL"
+	}
+	return "BYTEA NOT NULL"
+}
+
+func (opts *Options) quotedTable() string {
+	return quoteQualified(pgQuoteIdent, opts.Table)
+}
+
+// createTableSQL returns the statement creating the table with every enabled
+// feature column.
+func (opts *Options) createTableSQL() string {
+	cols := opts.columns()
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = c.name + " " + c.def
+	}
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", opts.quotedTable(), strings.Join(defs, ", "))
+	if opts.Partitions > 0 {
+		stmt += " PARTITION BY HASH (" + opts.keyColumn() + ")"
+	}
+	return stmt
+}
+
+// partitionSQL returns the statements creating the hash partitions of a
+// partitioned table.
+func (opts *Options) partitionSQL() []string {
+	var stmts []string
+	for i := 0; i < opts.Partitions; i++ {
+		name := quoteQualified(pgQuoteIdent, fmt.Sprintf("%s_p%d", opts.Table, i))
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+			name, opts.quotedTable(), opts.Partitions, i))
+	}
+	return stmts
+}
+
+// minimalCreateTableSQL returns the simplest statement creating the table,
+// with only the key and data columns.
+func (opts *Options) minimalCreateTableSQL() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s %s, %s %s)", opts.quotedTable(), opts.keyColumn(), opts.keyDef(), opts.dataColumn(), opts.dataDef())
+}
+
+// alterTableSQL returns the statements adding the optional feature columns to
+// a table created before those features were enabled. They are no-ops for
+// columns that already exist.
+func (opts *Options) alterTableSQL() []string {
+	var stmts []string
+	for _, c := range opts.columns()[2:] {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", opts.quotedTable(), c.name, c.def))
+	}
+	return stmts
+}
+
+// createSchema creates the table, or upgrades it with any newly enabled
+// feature columns. Several instances may start against the same table at
+// once, so a statement losing a race to create the same table or column is
+// not an error: the object it meant to create exists either way.
+func (opts *Options) createSchema(run func(string) error) error {
+	exec := func(stmt string) error {
+		if err := run(stmt); err != nil && !isConcurrentDDLError(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := exec(opts.createTableSQL()); err != nil {
+		// Some managed databases reject parts of the full statement but
+		// accept the minimal one; the feature columns are then added below.
+		if !isDDLFallbackError(err) {
+			return err
+		}
+		if err := exec(opts.minimalCreateTableSQL()); err != nil {
+			return err
+		}
+	} else {
+		for _, stmt := range opts.partitionSQL() {
+			if err := exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, stmt := range opts.alterTableSQL() {
+		if err := exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range opts.largeObjectSQL() {
+		if err := exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// largeObjectSQL returns the statements setting up large object storage: a
+// table tracking the objects the datastore creates, and a trigger moving
+// every value written into a large object and unlinking the object a row
+// stops referencing.
+//
+// The trigger also fires for the proposed row of an upsert, before
+// postgres finds the conflict, so upserts carry EXCLUDED.lo over along with
+// the data column. An upsert that then leaves the row alone orphans the
+// object made for it, which CleanOrphanLObjects removes.
+func (opts *Options) largeObjectSQL() []string {
+	if !opts.LargeObjects {
+		return nil
+	}
+	q := queries{tableName: opts.Table}
+	objects, fn, data := q.objectsTable(), quoteQualified(pgQuoteIdent, opts.Table+"_store_lo"), opts.dataColumn()
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + objects + " (oid OID PRIMARY KEY)",
+		`CREATE OR REPLACE FUNCTION ` + fn + `() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		PERFORM lo_unlink(m.oid) FROM pg_largeobject_metadata m WHERE m.oid = OLD.lo;
+		DELETE FROM ` + objects + ` WHERE oid = OLD.lo;
+		RETURN OLD;
+	END IF;
+	IF TG_OP = 'UPDATE' THEN
+		IF OLD.lo IS DISTINCT FROM NEW.lo OR octet_length(NEW.` + data + `) > 0 THEN
+			PERFORM lo_unlink(m.oid) FROM pg_largeobject_metadata m WHERE m.oid = OLD.lo;
+			DELETE FROM ` + objects + ` WHERE oid = OLD.lo;
+		END IF;
+	END IF;
+	IF octet_length(NEW.` + data + `) > 0 THEN
+		NEW.lo := lo_from_bytea(0, NEW.` + data + `);
+		INSERT INTO ` + objects + ` (oid) VALUES (NEW.lo);
+		NEW.` + data + ` := '';
+	END IF;
+	RETURN NEW;
+END $$`,
+		"CREATE TRIGGER store_lo BEFORE INSERT OR UPDATE OR DELETE ON " + opts.quotedTable() + " FOR EACH ROW EXECUTE PROCEDURE " + fn + "()",
+	}
+}
+
+// checkSchema verifies that the data column of the existing table has a type
+// matching the TextValues option.
+func (opts *Options) checkSchema(ctx context.Context, db *sql.DB) error {
+	var typ string
+	row := db.QueryRowContext(ctx, `SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attname = $2 AND NOT attisdropped`, opts.quotedTable(), opts.dataColumnName())
+	if err := row.Scan(&typ); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %s has no %s column", ErrSchemaMismatch, opts.Table, opts.dataColumnName())
+		}
+		return err
+	}
+	return opts.checkDataType(typ)
+}
+
+// checkDataType checks the data column's type, as printed by format_type.
+// A text column can't hold arbitrary bytes, so it is only accepted when
+// TextValues opts in to storing UTF-8 values.
+func (opts *Options) checkDataType(typ string) error {
+	isText := typ == "text" || strings.HasPrefix(typ, "character varying")
+	switch {
+	case typ == "bytea" && !opts.TextValues:
+		return nil
+	case isText && opts.TextValues:
+		return nil
+	case isText:
+		return fmt.Errorf("%w: data column of %s is %s; enable TextValues to store UTF-8 values in it", ErrSchemaMismatch, opts.Table, typ)
+	default:
+		return fmt.Errorf("%w: data column of %s is %s", ErrSchemaMismatch, opts.Table, typ)
+	}
+}
+
+// fingerprint describes the table the options make: a hash of the parts of
+// the schema fixed when the table is created, the key and data column types
+// and the partitioning, followed by the features changing how its rows are
+// read and written.
+func (opts *Options) fingerprint() string {
+	// The names are unquoted, so fingerprints don't depend on how the
+	// statements quote them.
+	desc := fmt.Sprintf("%s %s;%s %s;partitions=%d", opts.keyColumnName(), opts.keyDef(), opts.dataColumnName(), opts.dataDef(), opts.Partitions)
+	sum := sha256.Sum256([]byte(desc))
+	return strings.Join(append([]string{hex.EncodeToString(sum[:])}, opts.features()...), " ")
+}
+
+// features returns the names of the enabled features the fingerprint
+// records. A table may gain them, since enabling one adds its column in
+// place, but opening it with one left off would ignore the column, so that
+// expired keys are read or large objects go unread. TextValues is covered
+// by the data column's type.
+func (opts *Options) features() []string {
+	var features []string
+	if opts.Seq {
+		features = append(features, "seq")
+	}
+	if opts.TTL {
+		features = append(features, "ttl")
+	}
+	if opts.Checksums {
+		features = append(features, "checksums")
+	}
+	if opts.LargeObjects {
+		features = append(features, "lobjects")
+	}
+	return features
+}
+
+// compareFingerprint checks the fingerprint a table was stored with against
+// the options' fp, reporting whether fp adds features and should replace
+// it.
+func (opts *Options) compareFingerprint(stored, fp string) (bool, error) {
+	have, want := strings.Fields(stored), strings.Fields(fp)
+	if len(have) == 0 || have[0] != want[0] {
+		return false, fmt.Errorf("%w: %s was created with a different key type, value type or partitioning", ErrSchemaMismatch, opts.Table)
+	}
+	enabled := make(map[string]bool)
+	for _, f := range want[1:] {
+		enabled[f] = true
+	}
+	for _, f := range have[1:] {
+		if !enabled[f] {
+			return false, fmt.Errorf("%w: %s has %s enabled", ErrSchemaMismatch, opts.Table, f)
+		}
+	}
+	return len(want) > len(have), nil
+}
+
+// metaTable returns the quoted name of the table holding fingerprints, in
+// the same schema as the datastore's table.
+func (opts *Options) metaTable() string {
+	name := "sqlds_schema"
+	if i := strings.LastIndex(opts.Table, "."); i >= 0 {
+		name = opts.Table[:i+1] + name
+	}
+	return quoteQualified(pgQuoteIdent, name)
+}
+
+// checkFingerprint records the schema fingerprint for a newly created table
+// and verifies it on later opens, returning ErrSchemaMismatch if the table
+// was created with incompatible options or has features they leave off.
+// Opening with more features records them. Fingerprints are keyed by the
+// table's OID, so a dropped and recreated table starts afresh. Databases
+// refusing to create the fingerprint table skip the check.
+func (opts *Options) checkFingerprint(ctx context.Context, db *sql.DB) error {
+	meta := opts.metaTable()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+meta+" (relid OID PRIMARY KEY, fingerprint TEXT NOT NULL)"); err != nil {
+		if isDDLFallbackError(err) {
+			return nil
+		}
+		if !isConcurrentDDLError(err) {
+			return err
+		}
+	}
+
+	fp := opts.fingerprint()
+	_, err := db.ExecContext(ctx, "INSERT INTO "+meta+" (relid, fingerprint) VALUES ($1::regclass, $2) ON CONFLICT (relid) DO NOTHING", opts.quotedTable(), fp)
+	if err != nil {
+		return err
+	}
+
+	var stored string
+	if err := db.QueryRowContext(ctx, "SELECT fingerprint FROM "+meta+" WHERE relid = $1::regclass", opts.quotedTable()).Scan(&stored); err != nil {
+		return err
+	}
+	upgrade, err := opts.compareFingerprint(stored, fp)
+	if err != nil || !upgrade {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE "+meta+" SET fingerprint = $2 WHERE relid = $1::regclass AND fingerprint = $3", opts.quotedTable(), fp, stored)
+	return err
+}
+
+// isConcurrentDDLError reports whether err is what postgres returns when a
+// concurrent transaction created the same table, column or catalog entry
+// first, which IF NOT EXISTS doesn't guard against.
+func isConcurrentDDLError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	switch pqErr.Code {
+	case "42P07", // duplicate_table
+		"42701", // duplicate_column
+		"42710", // duplicate_object, such as a trigger
+		"23505": // unique_violation, on the system catalogs
+		return true
+	}
+	return false
+}
+
+// isDDLFallbackError reports whether err is a permission, syntax or
+// unsupported feature error, after which setup retries with minimal DDL.
+func isDDLFallbackError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	switch pqErr.Code {
+	case "42501", // insufficient_privilege
+		"42601", // syntax_error
+		"0A000": // feature_not_supported
+		return true
+	}
+	return false
+}
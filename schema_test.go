@@ -0,0 +1,625 @@
+package sqlds
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
+)
+
+func TestCreateTableSQL(t *testing.T) {
+	cases := []struct {
+		opts   Options
+		expect string
+	}{
+		{
+			Options{Table: "kv"},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL)",
+		},
+		{
+			Options{Table: "kv", Seq: true, TTL: true},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL, seq BIGSERIAL, expiration TIMESTAMPTZ)",
+		},
+		{
+			Options{Table: "kv", Seq: true, Timestamps: true, TTL: true},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL, seq BIGSERIAL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), expiration TIMESTAMPTZ)",
+		},
+		{
+			Options{Table: "kv", TTL: true, AccessTimes: true},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL, expiration TIMESTAMPTZ, accessed_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+		},
+		{
+			Options{Table: "kv", TextValues: true, Checksums: true},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key TEXT NOT NULL UNIQUE, data TEXT NOT NULL, checksum BYTEA GENERATED ALWAYS AS (sha256(convert_to(data, 'UTF8'))) STORED)",
+		},
+		{
+			Options{Table: "kv", MaxKeyLength: 256},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (key VARCHAR(256) NOT NULL UNIQUE, data BYTEA NOT NULL)",
+		},
+		{
+			Options{Table: "kv", KeyColumn: "k", DataColumn: "v", Checksums: true, Partitions: 2},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (\"k\" TEXT NOT NULL UNIQUE, \"v\" BYTEA NOT NULL, checksum BYTEA GENERATED ALWAYS AS (sha256(\"v\")) STORED) PARTITION BY HASH (\"k\")",
+		},
+		{
+			Options{Table: "kv", KeyColumn: "user", DataColumn: "order", Partitions: 2},
+			"CREATE TABLE IF NOT EXISTS \"kv\" (\"user\" TEXT NOT NULL UNIQUE, \"order\" BYTEA NOT NULL) PARTITION BY HASH (\"user\")",
+		},
+	}
+
+	for _, c := range cases {
+		if got := c.opts.createTableSQL(); got != c.expect {
+			t.Errorf("unexpected DDL:\n got: %s\nwant: %s", got, c.expect)
+		}
+	}
+
+	alters := (&Options{Table: "kv", Timestamps: true}).alterTableSQL()
+	if len(alters) != 1 || alters[0] != "ALTER TABLE \"kv\" ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()" {
+		t.Errorf("unexpected ALTERs: %v", alters)
+	}
+}
+
+func TestPartitionSQL(t *testing.T) {
+	opts := &Options{Table: "ipfs.kv", Partitions: 2}
+
+	expect := `CREATE TABLE IF NOT EXISTS "ipfs"."kv" (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL) PARTITION BY HASH (key)`
+	if got := opts.createTableSQL(); got != expect {
+		t.Errorf("unexpected DDL:\n got: %s\nwant: %s", got, expect)
+	}
+
+	parts := opts.partitionSQL()
+	if len(parts) != 2 ||
+		parts[0] != `CREATE TABLE IF NOT EXISTS "ipfs"."kv_p0" PARTITION OF "ipfs"."kv" FOR VALUES WITH (MODULUS 2, REMAINDER 0)` ||
+		parts[1] != `CREATE TABLE IF NOT EXISTS "ipfs"."kv_p1" PARTITION OF "ipfs"."kv" FOR VALUES WITH (MODULUS 2, REMAINDER 1)` {
+		t.Errorf("unexpected partition DDL: %v", parts)
+	}
+}
+
+func TestQualifiedTable(t *testing.T) {
+	setup := &Options{Table: "qualifiedtest"}
+	plain, err := setup.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		plain.db.Exec("DROP SCHEMA IF EXISTS sqlds_qualified CASCADE")
+		plain.db.Exec("DROP TABLE IF EXISTS qualifiedtest")
+		plain.Close()
+	}()
+	if _, err := plain.db.Exec("CREATE SCHEMA IF NOT EXISTS sqlds_qualified"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{Table: "sqlds_qualified.qualifiedtest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var schema string
+	if err := store.db.QueryRow("SELECT schemaname FROM pg_tables WHERE tablename = 'qualifiedtest' AND schemaname <> 'public'").Scan(&schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema != "sqlds_qualified" {
+		t.Fatalf("expected the table in sqlds_qualified, got %s", schema)
+	}
+
+	// The two tables of the same name are independent.
+	if err := store.Put(ds.NewKey("/a"), []byte("qualified")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Get(ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected the unqualified table to be untouched, got %v", err)
+	}
+	if v, err := store.Get(ds.NewKey("/a")); err != nil || string(v) != "qualified" {
+		t.Fatalf("expected the qualified value, got %q, %v", v, err)
+	}
+}
+
+func TestPartitionedTable(t *testing.T) {
+	opts := &Options{Table: "partitiontest", Partitions: 4}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS partitiontest")
+		store.Close()
+	}()
+
+	var partitions int
+	row := store.db.QueryRow("SELECT count(*) FROM pg_inherits WHERE inhparent = 'partitiontest'::regclass")
+	if err := row.Scan(&partitions); err != nil {
+		t.Fatal(err)
+	}
+	if partitions != 4 {
+		t.Fatalf("expected 4 partitions, got %d", partitions)
+	}
+
+	var keys []string
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("/part/%02d", i)
+		keys = append(keys, k)
+		if err := store.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rows landed in more than one partition.
+	var used int
+	row = store.db.QueryRow("SELECT count(DISTINCT tableoid) FROM partitiontest")
+	if err := row.Scan(&used); err != nil {
+		t.Fatal(err)
+	}
+	if used < 2 {
+		t.Fatalf("expected rows spread across partitions, got %d", used)
+	}
+
+	for _, k := range keys {
+		val, err := store.Get(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != k {
+			t.Fatalf("got wrong value for %s: %s", k, val)
+		}
+	}
+
+	rs, err := store.Query(dsq.Query{Prefix: "/part/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, keys)
+
+	if err := store.Delete(ds.NewKey(keys[0])); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := store.Has(ds.NewKey(keys[0])); err != nil || has {
+		t.Fatal("deleted key should be gone")
+	}
+}
+
+func TestCreateSchemaFallback(t *testing.T) {
+	opts := &Options{Table: "kv", Seq: true}
+	full := opts.createTableSQL()
+
+	m := &mockDB{handle: func(query string, _ []driver.Value) (mockResponse, error) {
+		if query == full {
+			return mockResponse{}, &pq.Error{Code: "42501", Message: "permission denied for option"}
+		}
+		return mockResponse{}, nil
+	}}
+	db := m.open()
+	defer db.Close()
+
+	err := opts.createSchema(func(stmt string) error {
+		_, err := db.Exec(stmt)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{full, opts.minimalCreateTableSQL()}
+	expect = append(expect, opts.alterTableSQL()...)
+	if got := m.statements(); strings.Join(got, ";") != strings.Join(expect, ";") {
+		t.Fatalf("unexpected statements:\n got: %v\nwant: %v", got, expect)
+	}
+
+	// Other errors are not retried.
+	errDown := errors.New("connection refused")
+	m.handle = func(string, []driver.Value) (mockResponse, error) {
+		return mockResponse{}, errDown
+	}
+	err = opts.createSchema(func(stmt string) error {
+		_, err := db.Exec(stmt)
+		return err
+	})
+	if !errors.Is(err, errDown) {
+		t.Fatalf("expected the original error, got %v", err)
+	}
+}
+
+func TestLargeObjectSQL(t *testing.T) {
+	if stmts := (&Options{Table: "kv"}).largeObjectSQL(); len(stmts) != 0 {
+		t.Errorf("expected no statements without large objects, got %v", stmts)
+	}
+
+	stmts := (&Options{Table: "ipfs.kv", DataColumn: "v", LargeObjects: true}).largeObjectSQL()
+	if len(stmts) != 3 ||
+		stmts[0] != `CREATE TABLE IF NOT EXISTS "ipfs"."kv_lobjects" (oid OID PRIMARY KEY)` ||
+		!strings.HasPrefix(stmts[1], `CREATE OR REPLACE FUNCTION "ipfs"."kv_store_lo"() RETURNS trigger`) ||
+		!strings.Contains(stmts[1], `NEW.lo := lo_from_bytea(0, NEW."v");`) ||
+		stmts[2] != `CREATE TRIGGER store_lo BEFORE INSERT OR UPDATE OR DELETE ON "ipfs"."kv" FOR EACH ROW EXECUTE PROCEDURE "ipfs"."kv_store_lo"()` {
+		t.Errorf("unexpected large object DDL: %v", stmts)
+	}
+
+	q := queries{tableName: "kv", largeObjects: true}
+	if got, want := q.Upsert(), `INSERT INTO "kv" (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data, lo = EXCLUDED.lo`; got != want {
+		t.Errorf("unexpected upsert:\n got: %s\nwant: %s", got, want)
+	}
+	if got, want := q.Get(), `SELECT coalesce(lo_get(lo), data) FROM "kv" WHERE key = $1`; got != want {
+		t.Errorf("unexpected get:\n got: %s\nwant: %s", got, want)
+	}
+
+	for _, opts := range []Options{
+		{LargeObjects: true, TextValues: true},
+		{LargeObjects: true, Checksums: true},
+		{LargeObjects: true, SkipIdenticalPuts: true},
+	} {
+		if err := opts.checkLargeObjects(); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%+v: expected ErrUnsupported, got %v", opts, err)
+		}
+	}
+}
+
+func TestCreateSchemaConcurrentAdd(t *testing.T) {
+	opts := &Options{Table: "kv", TTL: true}
+	m := &mockDB{handle: func(query string, _ []driver.Value) (mockResponse, error) {
+		if strings.HasPrefix(query, "ALTER TABLE") {
+			return mockResponse{}, &pq.Error{Code: "42701", Message: `column "expiration" of relation "kv" already exists`}
+		}
+		return mockResponse{}, &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}
+	}}
+	db := m.open()
+	defer db.Close()
+
+	err := opts.createSchema(func(stmt string) error {
+		_, err := db.Exec(stmt)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected lost creation races to be tolerated, got %v", err)
+	}
+}
+
+func TestConcurrentSchemaUpgrade(t *testing.T) {
+	opts := &Options{Table: "concurrentupgradetest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS concurrentupgradetest")
+		store.Close()
+	}()
+
+	const instances = 8
+	errs := make(chan error, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			upgraded := &Options{Table: "concurrentupgradetest", TTL: true, Timestamps: true}
+			s, err := upgraded.CreatePostgres()
+			if err == nil {
+				s.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent upgrade failed: %v", err)
+		}
+	}
+
+	cols := tableColumns(t, store, opts.Table)
+	if strings.Join(cols, ",") != "key,data,created_at,expiration" {
+		t.Errorf("unexpected columns after concurrent upgrade: %v", cols)
+	}
+}
+
+func tableColumns(t *testing.T, d *Datastore, table string) []string {
+	rows, err := d.db.Query("SELECT column_name FROM information_schema.columns WHERE table_name = $1 ORDER BY ordinal_position", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			t.Fatal(err)
+		}
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cols
+}
+
+func TestSchemaFeatures(t *testing.T) {
+	cases := []struct {
+		opts   Options
+		expect []string
+	}{
+		{Options{}, []string{"key", "data"}},
+		{Options{Seq: true}, []string{"key", "data", "seq"}},
+		{Options{Timestamps: true, TTL: true}, []string{"key", "data", "created_at", "expiration"}},
+		{Options{Seq: true, Timestamps: true, TTL: true}, []string{"key", "data", "seq", "created_at", "expiration"}},
+	}
+
+	for i, c := range cases {
+		opts := c.opts
+		opts.Table = fmt.Sprintf("schematest%d", i)
+		store, err := opts.CreatePostgres()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cols := tableColumns(t, store, opts.Table)
+		if strings.Join(cols, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("%s: expected columns %v, got %v", opts.Table, c.expect, cols)
+		}
+
+		store.db.Exec("DROP TABLE IF EXISTS " + opts.Table)
+		store.Close()
+	}
+}
+
+func TestCustomColumns(t *testing.T) {
+	// Reserved words work as well as plain names.
+	for _, cols := range [][2]string{{"k", "v"}, {"user", "select"}} {
+		testCustomColumns(t, cols[0], cols[1])
+	}
+}
+
+func testCustomColumns(t *testing.T, key, data string) {
+	opts := &Options{Table: "customcolumnstest", KeyColumn: key, DataColumn: data, Timestamps: true}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS " + opts.Table)
+		store.Close()
+	}()
+
+	if cols := tableColumns(t, store, opts.Table); strings.Join(cols, ",") != key+","+data+",created_at" {
+		t.Fatalf("unexpected columns %v", cols)
+	}
+	if err := store.Put(ds.NewKey("/a/b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(ds.NewKey("/a/b")); err != nil || string(v) != "1" {
+		t.Fatalf("expected the value put, got %q, %v", v, err)
+	}
+	rs, err := store.Query(dsq.Query{Prefix: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil || len(entries) != 1 || entries[0].Key != "/a/b" {
+		t.Fatalf("unexpected results %v, %v", entries, err)
+	}
+	if err := store.Delete(ds.NewKey("/a/b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	opts := &Options{Table: "schemaupgradetest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS schemaupgradetest")
+		store.Close()
+	}()
+
+	if err := store.Put(ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	upgraded := &Options{Table: "schemaupgradetest", Seq: true, TTL: true}
+	store2, err := upgraded.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+
+	cols := tableColumns(t, store2, upgraded.Table)
+	if strings.Join(cols, ",") != "key,data,seq,expiration" {
+		t.Errorf("unexpected columns after upgrade: %v", cols)
+	}
+
+	// Reopening with the same features is a no-op.
+	store3, err := upgraded.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store3.Close()
+
+	if _, err := store2.Get(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDataType(t *testing.T) {
+	cases := []struct {
+		typ        string
+		textValues bool
+		ok         bool
+	}{
+		{"bytea", false, true},
+		{"bytea", true, false},
+		{"text", false, false},
+		{"text", true, true},
+		{"character varying(255)", true, true},
+		{"jsonb", false, false},
+	}
+
+	for _, c := range cases {
+		opts := &Options{Table: "kv", TextValues: c.textValues}
+		err := opts.checkDataType(c.typ)
+		if c.ok && err != nil {
+			t.Errorf("%s with TextValues %v: unexpected error %v", c.typ, c.textValues, err)
+		}
+		if !c.ok && !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("%s with TextValues %v: expected ErrSchemaMismatch, got %v", c.typ, c.textValues, err)
+		}
+	}
+}
+
+func TestTextValues(t *testing.T) {
+	opts := &Options{Table: "texttest"}
+	d, err := (&Options{Table: "texttest_setup"}).CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		d.db.Exec("DROP TABLE IF EXISTS texttest_setup")
+		d.db.Exec("DROP TABLE IF EXISTS texttest")
+		d.Close()
+	}()
+
+	// An externally managed table storing values as TEXT.
+	if _, err := d.db.Exec("CREATE TABLE texttest (key TEXT NOT NULL UNIQUE, data TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec("INSERT INTO texttest (key, data) VALUES ('/external', 'héllo')"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := opts.CreatePostgres(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch for a TEXT data column, got %v", err)
+	}
+
+	opts.TextValues = true
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	val, err := store.Get(ds.NewKey("/external"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "héllo" {
+		t.Fatalf("expected the UTF-8 bytes of the stored text, got %q", val)
+	}
+
+	if err := store.Put(ds.NewKey("/written"), []byte("wörld")); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := store.db.QueryRow("SELECT data FROM texttest WHERE key = '/written'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "wörld" {
+		t.Fatalf("expected the value stored as text, got %q", stored)
+	}
+
+	rs, err := store.Query(dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/written"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Value) != "wörld" {
+		t.Fatalf("unexpected query results %v", entries)
+	}
+
+	if err := store.Put(ds.NewKey("/binary"), []byte{0xff, 0xfe}); err == nil {
+		t.Fatal("expected an error putting a value that isn't valid UTF-8")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	opts := &Options{Table: "kv"}
+	base := opts.fingerprint()
+	if fp := (&Options{Table: "kv", Timestamps: true, AccessTimes: true}).fingerprint(); fp != base {
+		t.Error("timestamp columns should not change the fingerprint")
+	}
+	for _, opts := range []Options{
+		{Table: "kv", MaxKeyLength: 64},
+		{Table: "kv", TextValues: true},
+		{Table: "kv", Partitions: 4},
+		{Table: "kv", Seq: true},
+		{Table: "kv", TTL: true},
+		{Table: "kv", Checksums: true},
+		{Table: "kv", LargeObjects: true},
+	} {
+		if opts.fingerprint() == base {
+			t.Errorf("%+v should change the fingerprint", opts)
+		}
+	}
+
+	// Features can be added but not left off.
+	ttl := (&Options{Table: "kv", TTL: true}).fingerprint()
+	if upgrade, err := opts.compareFingerprint(base, ttl); err != nil || !upgrade {
+		t.Errorf("expected enabling TTL to upgrade the fingerprint, got %v, %v", upgrade, err)
+	}
+	if upgrade, err := opts.compareFingerprint(ttl, ttl); err != nil || upgrade {
+		t.Errorf("expected a matching fingerprint, got %v, %v", upgrade, err)
+	}
+	if _, err := opts.compareFingerprint(ttl, base); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("expected ErrSchemaMismatch leaving TTL off, got %v", err)
+	}
+	seq := (&Options{Table: "kv", Seq: true}).fingerprint()
+	if _, err := opts.compareFingerprint(ttl, seq); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("expected ErrSchemaMismatch swapping TTL for Seq, got %v", err)
+	}
+}
+
+func TestSchemaFingerprintMismatch(t *testing.T) {
+	opts := &Options{Table: "fingerprinttest"}
+	store, err := opts.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.db.Exec("DROP TABLE IF EXISTS fingerprinttest")
+		store.Close()
+	}()
+
+	bounded := &Options{Table: "fingerprinttest", MaxKeyLength: 64}
+	if _, err := bounded.CreatePostgres(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch opening with a different key type, got %v", err)
+	}
+
+	upgraded := &Options{Table: "fingerprinttest", Seq: true}
+	store2, err := upgraded.CreatePostgres()
+	if err != nil {
+		t.Fatalf("enabling a feature column should still be allowed, got %v", err)
+	}
+	store2.Close()
+
+	// Once enabled, a feature can't be left off.
+	if _, err := opts.CreatePostgres(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch opening without Seq, got %v", err)
+	}
+	expiring := &Options{Table: "fingerprinttest", TTL: true}
+	if _, err := expiring.CreatePostgres(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch opening with TTL but without Seq, got %v", err)
+	}
+
+	// A recreated table takes the fingerprint of its new options.
+	if _, err := store.db.Exec("DROP TABLE fingerprinttest"); err != nil {
+		t.Fatal(err)
+	}
+	store3, err := bounded.CreatePostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store3.Close()
+	if _, err := opts.CreatePostgres(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch opening with the old key type, got %v", err)
+	}
+}
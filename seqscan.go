@@ -0,0 +1,85 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+)
+
+// seqScanGuard checks the plan of the first prefix query of each shape,
+// warning about those that would scan the whole table. A prefix's shape is
+// its depth: the planner's choice follows how selective the prefix is, which
+// prefixes of the same depth tend to share.
+type seqScanGuard struct {
+	mu      sync.Mutex
+	checked map[int]bool
+}
+
+func newSeqScanGuard() *seqScanGuard {
+	return &seqScanGuard{checked: make(map[int]bool)}
+}
+
+// check explains the prefix query for prefix on db unless its shape was
+// already checked. A failing check is not cached and doesn't fail the query,
+// nor, when db is a transaction, the statements that follow it.
+func (g *seqScanGuard) check(ctx context.Context, d *Datastore, db querier, prefix string) {
+	if g == nil || prefix == "" {
+		return
+	}
+	if _, ok := d.queries.(ExplainQueries); !ok {
+		return
+	}
+
+	shape := strings.Count(prefix, "/")
+	g.mu.Lock()
+	if g.checked[shape] {
+		g.mu.Unlock()
+		return
+	}
+	g.checked[shape] = true
+	g.mu.Unlock()
+
+	var used bool
+	var err error
+	if tx, ok := db.(*sql.Tx); ok {
+		used, err = d.indexUsedInTx(ctx, tx, prefix)
+	} else {
+		used, err = d.indexUsed(ctx, db, prefix)
+	}
+	if err != nil {
+		g.mu.Lock()
+		delete(g.checked, shape)
+		g.mu.Unlock()
+		return
+	}
+	if !used {
+		d.logf("sqlds: prefix queries such as %q scan the whole table; SuggestIndexes can recommend an index", prefix)
+	}
+}
+
+// indexUsedInTx is indexUsed inside a savepoint of tx, since on Postgres a
+// failing EXPLAIN would otherwise abort the caller's transaction.
+func (d *Datastore) indexUsedInTx(ctx context.Context, tx *sql.Tx, prefix string) (bool, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT sqlds_explain"); err != nil {
+		return false, err
+	}
+	used, err := d.indexUsed(ctx, tx, prefix)
+	if err != nil {
+		// The rollback must run even if ctx is what failed the EXPLAIN.
+		tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT sqlds_explain")
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT sqlds_explain")
+	return used, err
+}
+
+// logf writes a message to the configured logger, or the standard one.
+func (d *Datastore) logf(format string, args ...interface{}) {
+	if d.logger != nil {
+		d.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,201 @@
+package sqlds
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// defaultFlushEvery is how many operations a SpillBatch holds by default.
+const defaultFlushEvery = 10000
+
+// SpillOptions configure SpillingBatch.
+type SpillOptions struct {
+	// FlushEvery is how many pending operations are held before they are
+	// written in a transaction of their own. Defaults to 10000.
+	FlushEvery int
+	// Journal, when set, is the path of a file pending operations are
+	// appended to, in the format of JSONRecorder, until they are flushed.
+	// A SpillingBatch opened on a journal left behind by a process that
+	// stopped before flushing first writes the operations it holds.
+	// Appends are not synced, so the journal survives the process
+	// stopping, not the machine.
+	Journal string
+}
+
+// SpillBatch is a batch for more operations than fit in memory or in one
+// transaction. It holds at most FlushEvery pending operations, writing them
+// in a transaction of their own whenever that many have accumulated, so
+// unlike Batch its operations are not atomic as a whole: after a failure,
+// the operations already flushed stay written.
+type SpillBatch struct {
+	ctx        context.Context
+	d          *Datastore
+	flushEvery int
+	pending    []Op
+	flushed    int
+
+	journal *os.File
+	enc     *json.Encoder
+}
+
+// SpillingBatch returns a SpillBatch writing to the datastore, recovering
+// the operations left in opts.Journal if any.
+func (d *Datastore) SpillingBatch(ctx context.Context, opts SpillOptions) (*SpillBatch, error) {
+	b := &SpillBatch{ctx: ctx, d: d, flushEvery: opts.FlushEvery}
+	if b.flushEvery <= 0 {
+		b.flushEvery = defaultFlushEvery
+	}
+	if opts.Journal == "" {
+		return b, nil
+	}
+
+	f, err := os.OpenFile(opts.Journal, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.recover(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.journal = f
+	b.enc = json.NewEncoder(f)
+	return b, nil
+}
+
+// recover writes the operations in the journal f, FlushEvery at a time,
+// and empties it. Should that fail part way, the journal is left as it was
+// and replaying it again rewrites the same values in the same order.
+func (b *SpillBatch) recover(f *os.File) error {
+	dec := json.NewDecoder(f)
+	for {
+		var op Op
+		if err := dec.Decode(&op); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		b.pending = append(b.pending, op)
+		if len(b.pending) >= b.flushEvery {
+			if err := b.write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := b.write(); err != nil {
+		return err
+	}
+	return truncate(f)
+}
+
+func (b *SpillBatch) Put(key ds.Key, val []byte) error {
+	if val == nil {
+		return ErrInvalidType
+	}
+	if err := b.d.validateKey(key); err != nil {
+		return err
+	}
+	// The caller may reuse val once Put returns.
+	v := append([]byte{}, val...)
+	return b.add(Op{Type: OpPut, Key: key.String(), ValueLen: len(v), Value: v})
+}
+
+func (b *SpillBatch) Delete(key ds.Key) error {
+	if err := b.d.validateKey(key); err != nil {
+		return err
+	}
+	return b.add(Op{Type: OpDelete, Key: key.String()})
+}
+
+func (b *SpillBatch) add(op Op) error {
+	if b.enc != nil {
+		if err := b.enc.Encode(op); err != nil {
+			return err
+		}
+	}
+	b.pending = append(b.pending, op)
+	if len(b.pending) >= b.flushEvery {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush writes the pending operations in a single transaction.
+func (b *SpillBatch) Flush() error {
+	if err := b.write(); err != nil {
+		return err
+	}
+	if b.journal != nil {
+		return truncate(b.journal)
+	}
+	return nil
+}
+
+// Commit flushes the pending operations and removes the journal. The batch
+// can take more operations after it, but no longer journals them.
+func (b *SpillBatch) Commit() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	if b.journal == nil {
+		return nil
+	}
+
+	name := b.journal.Name()
+	err := b.journal.Close()
+	b.journal, b.enc = nil, nil
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Flushed returns the number of operations written so far.
+func (b *SpillBatch) Flushed() int {
+	return b.flushed
+}
+
+// write runs the pending operations in a transaction of their own.
+func (b *SpillBatch) write() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	txn, err := b.d.BatchContext(b.ctx)
+	if err != nil {
+		return err
+	}
+	for _, op := range b.pending {
+		switch op.Type {
+		case OpPut:
+			if op.Value == nil {
+				op.Value = []byte{}
+			}
+			err = txn.Put(ds.RawKey(op.Key), op.Value)
+		case OpDelete:
+			err = txn.Delete(ds.RawKey(op.Key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	b.flushed += len(b.pending)
+	b.pending = b.pending[:0]
+	return nil
+}
+
+// truncate empties f, leaving its offset at the start.
+func truncate(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
@@ -1,9 +1,16 @@
 package sqlds
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
+	ds "github.com/ipfs/go-datastore"
 	_ "github.com/lib/pq" //postgres driver
 )
 
@@ -14,39 +21,439 @@ type Options struct {
 	User     string
 	Password string
 	Database string
-	Table    string
+	// Table names the table, kv by default. A dotted name such as ipfs.kv
+	// is schema-qualified, each part quoted separately, and the table is
+	// created in that schema, which must already exist. Without a dot the
+	// table is found on the search path, usually in public.
+	Table string
+
+	// ConnectionString, when set, is passed to the driver as is in place of
+	// the connection string built from Host, Port, User, Password and
+	// Database, for settings those can't express, such as sslmode or
+	// connect_timeout. The replica, if any, is still connected to through
+	// the fields.
+	ConnectionString string
+
+	// SSLMode is the postgres sslmode to connect with, such as disable,
+	// require, verify-ca or verify-full. Defaults to disable. SSLRootCert,
+	// SSLCert and SSLKey, when set, are the paths of the CA certificate to
+	// verify the server with and of the client certificate and key to
+	// authenticate with.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// Params are extra driver parameters added to the connection string,
+	// such as connect_timeout, application_name or target_session_attrs.
+	// Use the fields above for the parameters they cover.
+	Params map[string]string
+
+	// ReplicaHost, when set, routes Get, Has, GetSize and GetWithOptions to
+	// a read replica at this host, connecting with the same credentials.
+	// Such reads may lag writes; use WithMinLSN or GetPrimary where a read
+	// must see an earlier write. ReplicaPort defaults to Port.
+	ReplicaHost string
+	ReplicaPort string
+
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime and ConnMaxIdleTime are
+	// applied to the connection pool, and to the replica's if there is one,
+	// through the sql.DB setters of the same names. Zero leaves the
+	// database/sql default in place; for MaxOpenConns that is no limit,
+	// which heavy concurrent use can turn into exhausting the server's
+	// connection slots.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// KeyCollation, when set, is applied with COLLATE to key comparisons and
+	// ordering in prefix queries. Use "C" to get the byte-wise lexicographic
+	// order go-datastore expects regardless of the database's default
+	// collation.
+	KeyCollation string
+
+	// SkipIdenticalPuts makes Put skip the row update entirely when the
+	// stored value is byte-identical, avoiding needless WAL churn for
+	// idempotent re-puts.
+	SkipIdenticalPuts bool
+
+	// Merge makes Put use a MERGE statement instead of INSERT ... ON
+	// CONFLICT on servers that have it, postgres 15 and later; older
+	// servers keep the INSERT. Unlike ON CONFLICT, MERGE doesn't wait out
+	// a concurrent insert of the same key, so racing Puts of a new key may
+	// fail with a unique violation.
+	Merge bool
+
+	// TextValues stores values in a TEXT data column instead of BYTEA, for
+	// tables managed outside this package. Values are converted between
+	// bytes and UTF-8 text in SQL; putting a value that isn't valid UTF-8
+	// fails. Setup checks that the data column's type matches this option
+	// and returns ErrSchemaMismatch otherwise.
+	TextValues bool
+
+	// LikeEscape is the character used to escape wildcards in LIKE patterns
+	// built from prefixes. Defaults to backslash. Keys match literally
+	// whichever character is chosen.
+	LikeEscape rune
+
+	// LegacyPrefixMatching matches query, DeletePrefix and DistinctValues
+	// prefixes as plain string prefixes, so that "/foo" also matches
+	// "/foobar" and differs from "/foo/". By default a prefix matches the
+	// keys below it at a segment boundary, with or without a trailing slash.
+	LegacyPrefixMatching bool
+
+	// SkipEmptyValues makes prefix queries exclude entries whose value is
+	// empty, filtering in SQL rather than in Go.
+	SkipEmptyValues bool
+
+	// Seq adds a seq column recording insertion order.
+	Seq bool
+	// Timestamps adds a created_at column recording when a key was first
+	// written.
+	Timestamps bool
+	// TTL adds an expiration column holding when a key expires.
+	TTL bool
+	// AccessTimes adds an accessed_at column recording when a key was last
+	// read, or first written if it hasn't been read since. Every successful
+	// Get then also updates the row, so leave it off unless GetAccessed is
+	// needed.
+	AccessTimes bool
+	// Checksums adds a checksum column holding the SHA-256 of each value,
+	// generated by the database on every write, for Verify to check values
+	// against. It requires postgres 12 or later.
+	Checksums bool
+	// LargeObjects stores values in postgres large objects, for values too
+	// big to keep inline. A trigger moves each value written into a large
+	// object referenced by the row's lo column, leaving the data column
+	// empty, and unlinks the object when the row is overwritten or deleted.
+	// The objects are tracked in a <table>_lobjects table, for
+	// CleanOrphanLObjects. Sizes are read from the objects, so GetSize and
+	// queries returning sizes read every value they measure. It can't be
+	// combined with TextValues, Checksums or SkipIdenticalPuts, and needs
+	// postgres 13 or later with Partitions.
+	LargeObjects bool
+
+	// KeyValidator, when set, is called with every key before it is written
+	// or deleted, including in batches. A non-nil error is returned to the
+	// caller without touching the database.
+	KeyValidator func(ds.Key) error
+
+	// MaxKeyLength, when nonzero, makes writes and deletes of keys longer
+	// than this many characters fail with ErrKeyTooLong before reaching the
+	// database, on every backend. Postgres also creates the key column as
+	// VARCHAR of this many characters rather than unbounded TEXT, and MySQL
+	// as VARBINARY of this many bytes, at most 3072, rather than 3072 bytes.
+	// SQLite and CockroachDB leave the column unbounded.
+	MaxKeyLength int
+
+	// QueryBufferSize is the number of results QueryChan buffers ahead of a
+	// slow consumer. Defaults to 64.
+	QueryBufferSize int
+
+	// Partitions, when nonzero, creates the table partitioned by a hash of
+	// the key into this many partitions. Reads and writes are unaffected.
+	// It only applies when the table is first created.
+	Partitions int
+
+	// AnalyzeThreshold, when nonzero, runs ANALYZE on the table after a
+	// batch commit or bulk delete that changed at least this many rows.
+	AnalyzeThreshold int64
+
+	// BatchHooks are called over the lifecycle of every batch's transaction.
+	BatchHooks BatchHooks
+
+	// SerializationRetries, when nonzero, replays a batch's transaction up
+	// to this many times after it fails with a serialization failure
+	// (SQLSTATE 40001), as databases running transactions at SERIALIZABLE
+	// isolation expect clients to. Batches then keep their operations in
+	// memory until Commit. A batch whose transaction was handed out by
+	// GetTransaction isn't retried. CreateCockroach defaults it to 5.
+	SerializationRetries int
+
+	// NegativeCacheSize enables caching up to this many keys that Get found
+	// to be missing, so repeated misses skip the database. The cache only
+	// sees writes made through this Datastore.
+	NegativeCacheSize int
+	// NegativeCacheTTL bounds how long a miss is cached. Defaults to one
+	// minute when the negative cache is enabled.
+	NegativeCacheTTL time.Duration
+
+	// PrepareStatements caches prepared statements for Get, Has, GetSize,
+	// Put and Delete. Stats reports how often the cache is hit.
+	PrepareStatements bool
+
+	// Recorder, when set, is called with every Get, Has, GetSize, Put and
+	// Delete and its outcome, and with the writes of each batch and
+	// transaction once committed. JSONRecorder writes a log that Replay can
+	// re-apply to another datastore.
+	Recorder func(Op)
+
+	// Timings, when set, is called after every Get, Has, GetSize, Put and
+	// Delete with the time it waited for a connection and the time it
+	// spent executing, which Stats also totals. Measuring gives each
+	// operation a connection acquired up front, on which statements run
+	// unprepared, so it bypasses PrepareStatements.
+	Timings func(OpTiming)
+
+	// CircuitBreakerThreshold, when nonzero, makes Get, Has, GetSize, Put,
+	// Delete and Query fail fast with ErrCircuitOpen after this many
+	// consecutive failures to reach the database, such as connection errors
+	// and timeouts, instead of each waiting on a struggling database.
+	// Statements the database rejects don't count.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long the breaker stays open before a
+	// single probe request is let through. Defaults to 30 seconds when the
+	// breaker is enabled.
+	CircuitBreakerCooldown time.Duration
+
+	// CoalesceWindow, when nonzero, holds each Put for up to this long
+	// before writing it, so that puts to the same key within the window
+	// make a single write of the last value. Put returns once the value is
+	// held. Reads of given keys see held values; queries, bulk deletes,
+	// merges, imports and new transactions write them first, and batch and
+	// transaction writes replace them. Sync and Close write them at once.
+	// A value the database rejects is logged and dropped, failing the call
+	// that was writing it; other failed writes are retried after another
+	// window. Puts after Close are written at once.
+	CoalesceWindow time.Duration
+
+	// CloseTimeout, when nonzero, makes Close wait up to this long for open
+	// batches to commit or roll back and for streams from QueryChan and
+	// AllKeys to be read to the end or cancelled. By default, and for what
+	// is still running once the timeout passes, Close stops the streams at
+	// once: QueryChan and AllKeys send a final result with ErrClosed before
+	// closing their channels. A batch's transaction
+	// keeps its connection until it commits or rolls back either way.
+	CloseTimeout time.Duration
+
+	// IndexAdvisor records the distinct prefixes queried, for
+	// SuggestIndexes to recommend indexes for.
+	IndexAdvisor bool
+
+	// WarnSeqScans checks the plan of the first prefix query of each depth
+	// and logs a warning if it would scan the whole table rather than use
+	// an index, surfacing missing indexes. The check costs an EXPLAIN, so
+	// it is off by default. Only postgres can explain queries; elsewhere
+	// it does nothing.
+	WarnSeqScans bool
+	// Logger receives the datastore's warnings. Defaults to the standard
+	// logger.
+	Logger *log.Logger
+
+	// MaxKeys, when nonzero, caps the number of rows: a background reaper
+	// counts them every ReapInterval, one minute by default, and deletes
+	// the excess by EvictBy. The table may exceed the cap in between. It
+	// requires Seq to evict the oldest written rows, or AccessTimes to
+	// evict the least recently read.
+	MaxKeys      int64
+	ReapInterval time.Duration
+	EvictBy      EvictionPolicy
+
+	// EmptyCheckTTL is how long QueryAnnotated reuses its check of whether
+	// the table is empty. Defaults to one second.
+	EmptyCheckTTL time.Duration
+
+	// MaxScanBytes, when nonzero, aborts a query once the values of the rows
+	// it has read add up to more than this many bytes, counting rows later
+	// dropped by filters. Query returns ErrScanBudgetExceeded in a
+	// PartialResultError holding the entries read within the budget.
+	MaxScanBytes int64
+
+	// GetSizeFallback makes GetSize fetch the value and measure it when the
+	// statement measuring it in SQL fails, as it does on a table whose data
+	// column isn't of a type octet_length accepts. A done context or an
+	// exhausted pool is still returned as is.
+	GetSizeFallback bool
+
+	// KeyColumn and DataColumn name the table's key and data columns,
+	// defaulting to key and data, for tables shared with other software.
+	// Names must be lowercase letters, digits and underscores, not
+	// starting with a digit. They are quoted, so reserved words like user
+	// are allowed.
+	KeyColumn  string
+	DataColumn string
+}
+
+// columnName matches the column names accepted for KeyColumn and
+// DataColumn: identifiers postgres wouldn't change the case of unquoted, so
+// that the names match whether or not other software quotes them.
+var columnName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// checkColumns returns ErrInvalidColumn for a KeyColumn or DataColumn that
+// columnName doesn't match.
+func (opts *Options) checkColumns() error {
+	for _, name := range []string{opts.KeyColumn, opts.DataColumn} {
+		if name != "" && !columnName.MatchString(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidColumn, name)
+		}
+	}
+	if opts.KeyColumn != "" && opts.KeyColumn == opts.DataColumn {
+		return fmt.Errorf("%w: key and data columns are both %q", ErrInvalidColumn, opts.KeyColumn)
+	}
+	return nil
+}
+
+// checkEviction returns ErrUnsupported if MaxKeys is set without the column
+// EvictBy orders rows by.
+func (opts *Options) checkEviction() error {
+	if opts.MaxKeys <= 0 {
+		return nil
+	}
+	if opts.EvictBy == EvictLeastRecentlyRead && !opts.AccessTimes {
+		return fmt.Errorf("%w: evicting the least recently read keys needs AccessTimes", ErrUnsupported)
+	}
+	if opts.EvictBy == EvictOldestWritten && !opts.Seq {
+		return fmt.Errorf("%w: evicting the oldest written keys needs Seq", ErrUnsupported)
+	}
+	return nil
+}
+
+// checkLargeObjects returns ErrUnsupported for the options LargeObjects
+// can't be combined with, which read or compare the data column the values
+// are moved out of.
+func (opts *Options) checkLargeObjects() error {
+	if !opts.LargeObjects {
+		return nil
+	}
+	if opts.TextValues || opts.Checksums || opts.SkipIdenticalPuts {
+		return fmt.Errorf("%w: large objects can't be combined with TextValues, Checksums or SkipIdenticalPuts", ErrUnsupported)
+	}
+	return nil
+}
+
+// keyColumn and dataColumn return the configured columns, quoted, or their
+// defaults, for use in statements.
+func (opts *Options) keyColumn() string {
+	return queries{keyColumn: opts.KeyColumn}.keyCol()
+}
+
+func (opts *Options) dataColumn() string {
+	return queries{dataColumn: opts.DataColumn}.dataCol()
+}
+
+// keyColumnName and dataColumnName return the names of the columns
+// unquoted, as the catalog has them.
+func (opts *Options) keyColumnName() string {
+	if opts.KeyColumn == "" {
+		return "key"
+	}
+	return opts.KeyColumn
+}
+
+func (opts *Options) dataColumnName() string {
+	if opts.DataColumn == "" {
+		return "data"
+	}
+	return opts.DataColumn
 }
 
 type queries struct {
-	tableName string
+	tableName       string
+	keyColumn       string
+	dataColumn      string
+	collation       string
+	skipEmptyValues bool
+	seq             bool
+	timestamps      bool
+	accessTimes     bool
+	ttl             bool
+	merge           bool
+	checksums       bool
+	skipIdentical   bool
+	textValues      bool
+	escape          rune
+	largeObjects    bool
 }
 
 func NewQueriesForTable(tableName string) *queries {
-	return &queries{tableName}
+	return &queries{tableName: tableName}
 }
 
 func (q queries) Delete() string {
-	return `DELETE FROM ` + q.tableName + ` WHERE key = $1`
+	return `DELETE FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = $1`
 }
 
 func (q queries) Exists() string {
-	return `SELECT exists(SELECT 1 FROM ` + q.tableName + ` WHERE key=$1)`
+	return `SELECT exists(SELECT 1 FROM ` + q.table() + ` WHERE ` + q.keyCol() + `=$1)`
 }
 
 func (q queries) Get() string {
-	return `SELECT data FROM ` + q.tableName + ` WHERE key = $1`
+	return `SELECT ` + q.data() + ` FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = $1` + q.latest()
 }
 
 func (q queries) Put() string {
-	return `INSERT INTO ` + q.tableName + ` (key, data) SELECT $1, $2 WHERE NOT EXISTS ( SELECT key FROM ` + q.tableName + ` WHERE key = $1)`
+	if q.merge {
+		return q.mergePut()
+	}
+	if q.skipIdentical {
+		return `INSERT INTO ` + q.table() + ` AS t (` + q.keyCol() + `, ` + q.dataCol() + `) VALUES ($1, ` + q.value() + `) ON CONFLICT (` + q.keyCol() + `) DO UPDATE SET ` + q.dataCol() + ` = EXCLUDED.` + q.dataCol() + ` WHERE t.` + q.dataCol() + ` IS DISTINCT FROM EXCLUDED.` + q.dataCol()
+	}
+	return q.Upsert()
+}
+
+// mergePut is Put as a MERGE statement. The parameters are cast since
+// nothing else in a VALUES list fixes their types.
+func (q queries) mergePut() string {
+	matched := `WHEN MATCHED`
+	if q.skipIdentical {
+		matched += ` AND t.` + q.dataCol() + ` IS DISTINCT FROM s.data`
+	}
+	key, data := q.keyCol(), q.dataCol()
+	return `MERGE INTO ` + q.table() + ` AS t USING (VALUES ($1::text, ` + q.encode(`$2::bytea`) + `)) AS s (key, data) ON t.` + key + ` = s.key ` +
+		matched + ` THEN UPDATE SET ` + q.setData(`s.data`) + ` WHEN NOT MATCHED THEN INSERT (` + key + `, ` + data + `) VALUES (s.key, s.data)`
 }
 
 func (q queries) Query() string {
-	return `SELECT key, data FROM ` + q.tableName
+	return `SELECT ` + q.keyCol() + `, ` + q.data() + ` FROM ` + q.table()
+}
+
+func (q queries) QueryKeysOnly() string {
+	return `SELECT ` + q.keyCol() + ` FROM ` + q.table()
+}
+
+func (q queries) QuerySizes() string {
+	return `SELECT ` + q.keyCol() + `, octet_length(` + q.stored() + `) FROM ` + q.table()
+}
+
+func (q queries) TotalSize() string {
+	return `SELECT coalesce(sum(octet_length(` + q.stored() + `)), 0) FROM ` + q.table()
+}
+
+func (q queries) Empty() string {
+	return `SELECT NOT EXISTS (SELECT 1 FROM ` + q.table() + `)`
 }
 
 func (q queries) Prefix() string {
-	return ` WHERE key LIKE '%s%%' ORDER BY key`
+	return q.prefixWhere() + ` ORDER BY ` + q.keyExpr()
+}
+
+func (q queries) PrefixDescending() string {
+	return q.prefixWhere() + ` ORDER BY ` + q.keyExpr() + ` DESC`
+}
+
+func (q queries) PrefixByKeyLength() string {
+	return q.prefixWhere() + q.OrderByKeyLength()
+}
+
+func (q queries) OrderByKeyLength() string {
+	return ` ORDER BY char_length(` + q.keyCol() + `), ` + q.keyExpr()
+}
+
+func (q queries) prefixWhere() string {
+	where := ` WHERE ` + q.keyExpr() + ` LIKE $1` + q.escapeClause()
+	if q.skipEmptyValues {
+		where += ` AND octet_length(` + q.stored() + `) > 0`
+	}
+	return where
+}
+
+func (q queries) OrderByKey() string {
+	return ` ORDER BY ` + q.keyExpr()
+}
+
+func (q queries) OrderByKeyDescending() string {
+	return ` ORDER BY ` + q.keyExpr() + ` DESC`
 }
 
 func (q queries) Limit() string {
@@ -58,27 +465,605 @@ func (q queries) Offset() string {
 }
 
 func (q queries) GetSize() string {
-	return `SELECT octet_length(data) FROM ` + q.tableName + ` WHERE key = $1`
+	return `SELECT octet_length(` + q.stored() + `) FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = $1` + q.latest()
+}
+
+// data returns the expression selecting a value as bytes.
+func (q queries) data() string {
+	if q.textValues {
+		return `convert_to(` + q.dataCol() + `, 'UTF8')`
+	}
+	return q.stored()
+}
+
+// stored returns the expression selecting a value as stored: the data
+// column, or the large object the row references if it has one.
+func (q queries) stored() string {
+	if q.largeObjects {
+		return `coalesce(lo_get(lo), ` + q.dataCol() + `)`
+	}
+	return q.dataCol()
+}
+
+// setExcluded returns the DO UPDATE assignments of an upsert's value. With
+// large objects, the object the trigger made for the proposed row comes
+// along.
+func (q queries) setExcluded() string {
+	set := q.dataCol() + ` = EXCLUDED.` + q.dataCol()
+	if q.largeObjects {
+		set += `, lo = EXCLUDED.lo`
+	}
+	return set
+}
+
+// setData returns the UPDATE assignments of the value expression expr.
+// With large objects, the row's object is dropped for the trigger to
+// replace, so that an empty value doesn't keep the old one.
+func (q queries) setData(expr string) string {
+	set := q.dataCol() + ` = ` + expr
+	if q.largeObjects {
+		set += `, lo = NULL`
+	}
+	return set
+}
+
+// value returns the expression storing the value parameter $2.
+func (q queries) value() string {
+	return q.encode(`$2`)
+}
+
+// encode returns the expression storing the bytes expr as a value.
+func (q queries) encode(expr string) string {
+	if q.textValues {
+		return `convert_from(` + expr + `, 'UTF8')`
+	}
+	return expr
+}
+
+// latest picks the newest row for a key when the seq column is enabled, so
+// reads are deterministic on legacy tables holding duplicate keys.
+func (q queries) latest() string {
+	if !q.seq {
+		return ""
+	}
+	return ` ORDER BY seq DESC LIMIT 1`
+}
+
+func (q queries) ExistingKeys() string {
+	return `SELECT ` + q.keyCol() + ` FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = ANY($1::text[])`
+}
+
+func (q queries) Compact() string {
+	return `VACUUM FULL ` + q.table()
+}
+
+func (q queries) Reindex() string {
+	return `REINDEX TABLE ` + q.table()
+}
+
+func (q queries) Vacuum() string {
+	return `VACUUM ` + q.table()
+}
+
+func (q queries) Analyze() string {
+	return `ANALYZE ` + q.table()
+}
+
+func (q queries) DeletePrefix() string {
+	return `DELETE FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` LIKE $1` + q.escapeClause()
+}
+
+func (q queries) DeleteMany() string {
+	return `DELETE FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = ANY($1)`
+}
+
+func (q queries) SizesMany() string {
+	return `SELECT ` + q.keyCol() + `, octet_length(` + q.stored() + `) FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = ANY($1)`
+}
+
+func (q queries) GetMany() string {
+	return `SELECT ` + q.keyCol() + `, ` + q.data() + ` FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = ANY($1::text[])`
+}
+
+func (q queries) CreatedBetween() string {
+	if !q.timestamps {
+		return ""
+	}
+	return `SELECT ` + q.keyCol() + `, ` + q.data() + ` FROM ` + q.table() + ` WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at`
+}
+
+func (q queries) PutExpiring() string {
+	if !q.ttl {
+		return ""
+	}
+	return `INSERT INTO ` + q.table() + ` (` + q.keyCol() + `, ` + q.dataCol() + `, expiration) VALUES ($1, ` + q.value() + `, $3) ON CONFLICT (` + q.keyCol() + `) DO UPDATE SET ` + q.setExcluded() + `, expiration = EXCLUDED.expiration`
+}
+
+func (q queries) ExpiringBefore() string {
+	if !q.ttl {
+		return ""
+	}
+	return `SELECT ` + q.keyCol() + `, ` + q.data() + `, expiration FROM ` + q.table() + ` WHERE expiration <= $1 AND expiration > now() ORDER BY expiration LIMIT $2`
+}
+
+func (q queries) VerifyPage() string {
+	if !q.checksums {
+		return ""
+	}
+	key := q.keyExpr()
+	return `SELECT ` + q.keyCol() + `, ` + q.dataCol() + `, checksum FROM ` + q.table() + ` WHERE ` + key + ` > $1 ORDER BY ` + key + ` LIMIT $2`
+}
+
+func (q queries) CompareAndSwap() string {
+	return `UPDATE ` + q.table() + ` SET ` + q.setData(q.encode(`$3`)) + ` WHERE ` + q.keyCol() + ` = $1 AND ` + q.data() + ` = $2` + q.latestRow()
 }
 
-// Create returns a datastore connected to postgres initialized with a table
+func (q queries) CompareAndSwapHash() string {
+	if !q.checksums {
+		return ""
+	}
+	return `UPDATE ` + q.table() + ` SET ` + q.setData(q.encode(`$3`)) + ` WHERE ` + q.keyCol() + ` = $1 AND checksum = $2` + q.latestRow()
+}
+
+// latestRow restricts an UPDATE of the key $1 to the row latest reads,
+// which only differs from the others on legacy tables holding duplicate
+// keys: upserts update a key's single row in place, seq and all.
+func (q queries) latestRow() string {
+	if !q.seq {
+		return ""
+	}
+	return ` AND seq = (SELECT max(seq) FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = $1)`
+}
+
+func (q queries) CountRows() string {
+	return `SELECT count(*) FROM ` + q.table()
+}
+
+func (q queries) EvictOldestWritten() string {
+	if !q.seq {
+		return ""
+	}
+	return `DELETE FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` IN (SELECT ` + q.keyCol() + ` FROM ` + q.table() + ` ORDER BY seq LIMIT $1)`
+}
+
+func (q queries) EvictLeastRecentlyRead() string {
+	if !q.accessTimes {
+		return ""
+	}
+	return `DELETE FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` IN (SELECT ` + q.keyCol() + ` FROM ` + q.table() + ` ORDER BY accessed_at LIMIT $1)`
+}
+
+func (q queries) Touch() string {
+	if !q.accessTimes {
+		return ""
+	}
+	return `UPDATE ` + q.table() + ` SET accessed_at = now() WHERE ` + q.keyCol() + ` = $1`
+}
+
+func (q queries) Accessed() string {
+	if !q.accessTimes {
+		return ""
+	}
+	return `SELECT accessed_at FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = $1`
+}
+
+func (q queries) Events() string {
+	if !q.seq {
+		return ""
+	}
+	return `SELECT seq, ` + q.keyCol() + `, ` + q.data() + ` FROM ` + q.table() + ` WHERE seq > $1 ORDER BY seq LIMIT $2`
+}
+
+func (q queries) DistinctValues() string {
+	hash := `md5(` + q.stored() + `)`
+	return `SELECT ` + hash + `, count(*) FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` LIKE $1` + q.escapeClause() + ` GROUP BY ` + hash + ` ORDER BY count(*) DESC, ` + hash
+}
+
+func (q queries) LockValues() string {
+	return `SELECT ` + q.keyCol() + `, ` + q.data() + ` FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` = ANY($1) ORDER BY ` + q.keyCol() + ` FOR UPDATE`
+}
+
+func (q queries) Upsert() string {
+	return `INSERT INTO ` + q.table() + ` (` + q.keyCol() + `, ` + q.dataCol() + `) VALUES ($1, ` + q.value() + `) ON CONFLICT (` + q.keyCol() + `) DO UPDATE SET ` + q.setExcluded()
+}
+
+func (q queries) Explain(stmt string) string {
+	return `EXPLAIN (FORMAT JSON) ` + stmt
+}
+
+// PatternIndex names the index after the table. Unqualified, the name puts
+// it in the table's own schema.
+func (q queries) PatternIndex() string {
+	name := q.tableName
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return `CREATE INDEX CONCURRENTLY IF NOT EXISTS ` + q.QuoteIdent(name+"_key_pattern_idx") + ` ON ` + q.table() + ` (` + q.keyCol() + ` text_pattern_ops)`
+}
+
+func (q queries) OrphanLargeObjects() string {
+	if !q.largeObjects {
+		return ""
+	}
+	return `SELECT o.oid FROM ` + q.objectsTable() + ` o JOIN pg_largeobject_metadata m ON m.oid = o.oid WHERE ` + q.unreferenced() + ` ORDER BY o.oid`
+}
+
+func (q queries) UnlinkOrphanLargeObjects() string {
+	if !q.largeObjects {
+		return ""
+	}
+	return `WITH o AS (DELETE FROM ` + q.objectsTable() + ` o WHERE ` + q.unreferenced() + ` RETURNING o.oid) ` +
+		`SELECT count(lo_unlink(m.oid)) FROM o JOIN pg_largeobject_metadata m ON m.oid = o.oid`
+}
+
+// unreferenced matches the tracked objects o no row references.
+func (q queries) unreferenced() string {
+	return `NOT EXISTS (SELECT 1 FROM ` + q.table() + ` t WHERE t.lo = o.oid)`
+}
+
+// objectsTable returns the quoted name of the table tracking the large
+// objects the datastore created.
+func (q queries) objectsTable() string {
+	return quoteQualified(q.QuoteIdent, q.tableName+"_lobjects")
+}
+
+func (q queries) CreateImportTable(name string) string {
+	return `CREATE TEMPORARY TABLE ` + q.QuoteIdent(name) + ` (ord BIGSERIAL, key TEXT NOT NULL, data BYTEA NOT NULL) ON COMMIT DROP`
+}
+
+func (q queries) MergeImport(name string, onConflict ConflictPolicy) string {
+	// The last occurrence of a key in the import wins.
+	key, data := q.keyCol(), q.dataCol()
+	stmt := `INSERT INTO ` + q.table() + ` (` + key + `, ` + data + `) SELECT DISTINCT ON (key) key, ` + q.encode(`data`) +
+		` FROM ` + q.QuoteIdent(name) + ` ORDER BY key, ord DESC`
+	switch onConflict {
+	case ConflictSkip:
+		stmt += ` ON CONFLICT (` + key + `) DO NOTHING`
+	case ConflictOverwrite:
+		stmt += ` ON CONFLICT (` + key + `) DO UPDATE SET ` + q.setExcluded()
+	}
+	return stmt
+}
+
+func (q queries) NonEmptyPrefixes() string {
+	return `SELECT DISTINCT array_to_string((string_to_array(substring(` + q.keyCol() + ` from $2), '/'))[1:$3], '/') FROM ` + q.table() + ` WHERE ` + q.keyCol() + ` LIKE $1` + q.escapeClause()
+}
+
+func (q queries) DeclareKeysCursor(name string) string {
+	return `DECLARE ` + q.QuoteIdent(name) + ` NO SCROLL CURSOR FOR SELECT ` + q.keyCol() + ` FROM ` + q.table()
+}
+
+func (q queries) FetchCursor(name string, count int) string {
+	return fmt.Sprintf(`FETCH FORWARD %d FROM %s`, count, q.QuoteIdent(name))
+}
+
+func (q queries) CloseCursor(name string) string {
+	return `CLOSE ` + q.QuoteIdent(name)
+}
+
+func (q queries) CurrentLSN() string {
+	return `SELECT pg_current_wal_lsn()::text`
+}
+
+func (q queries) LSNReplayed() string {
+	return `SELECT NOT pg_is_in_recovery() OR coalesce(pg_last_wal_replay_lsn() >= $1::pg_lsn, false)`
+}
+
+func (q queries) Bloat() string {
+	table := strings.Replace(q.table(), "'", "''", -1)
+	return `SELECT n_live_tup, n_dead_tup FROM pg_stat_user_tables WHERE relid = '` + table + `'::regclass`
+}
+
+func (q queries) DiskUsage() string {
+	table := strings.Replace(q.table(), "'", "''", -1)
+	return `SELECT pg_total_relation_size('` + table + `'::regclass)`
+}
+
+func (q queries) LikeEscape() rune {
+	if q.escape == 0 {
+		return '\\'
+	}
+	return q.escape
+}
+
+// escapeClause declares LikeEscape for a LIKE. A backslash is written as an
+// escape string constant, which reads the same whether or not
+// standard_conforming_strings is on.
+func (q queries) escapeClause() string {
+	e := q.LikeEscape()
+	switch e {
+	case '\\':
+		return ` ESCAPE E'\\'`
+	case '\'':
+		return ` ESCAPE ''''`
+	}
+	return ` ESCAPE '` + string(e) + `'`
+}
+
+// QuoteIdent quotes a single identifier, so that reserved words and names
+// with special characters can be used as table and column names.
+func (q queries) QuoteIdent(name string) string {
+	return pgQuoteIdent(name)
+}
+
+// table returns the quoted table name. A dotted name is treated as
+// schema-qualified, and each part is quoted separately.
+func (q queries) table() string {
+	return quoteQualified(q.QuoteIdent, q.tableName)
+}
+
+func pgQuoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteQualified(quote func(string) string, name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// keyExpr returns the key column, with the configured collation applied.
+func (q queries) keyExpr() string {
+	if q.collation == "" {
+		return q.keyCol()
+	}
+	name := strings.Replace(q.collation, `"`, `""`, -1)
+	return q.keyCol() + ` COLLATE "` + name + `"`
+}
+
+// keyCol and dataCol return the key and data columns, quoted when
+// configured, as a configured name may be a reserved word.
+func (q queries) keyCol() string {
+	if q.keyColumn == "" {
+		return "key"
+	}
+	return q.QuoteIdent(q.keyColumn)
+}
+
+func (q queries) dataCol() string {
+	if q.dataColumn == "" {
+		return "data"
+	}
+	return q.QuoteIdent(q.dataColumn)
+}
+
+// Create returns a datastore connected to postgres initialized with a table.
+// It pings the database before anything else, so unreachable servers and bad
+// credentials fail here rather than at the first operation.
 func (opts *Options) CreatePostgres() (*Datastore, error) {
+	return opts.CreatePostgresContext(context.Background())
+}
+
+// CreatePostgresContext is like CreatePostgres, but gives up connecting and
+// setting up the table once ctx is done, returning ctx.Err().
+func (opts *Options) CreatePostgresContext(ctx context.Context) (*Datastore, error) {
+	if err := opts.checkColumns(); err != nil {
+		return nil, err
+	}
+	if err := opts.checkEviction(); err != nil {
+		return nil, err
+	}
+	if err := opts.checkLargeObjects(); err != nil {
+		return nil, err
+	}
 	opts.setDefaults()
-	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=disable"
-	constr := fmt.Sprintf(fmtstr, opts.Database, opts.Host, opts.Port, opts.User, opts.Password)
-	db, err := sql.Open("postgres", constr)
+	dsn := opts.ConnectionString
+	if dsn == "" {
+		dsn = opts.dsn(opts.Host, opts.Port)
+	}
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
+	opts.configurePool(db)
+
+	if err := pingContext(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	createTable := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL)", opts.Table)
-	_, err = db.Exec(createTable)
+	err = opts.createSchema(func(stmt string) error {
+		_, err := db.ExecContext(ctx, stmt)
+		return err
+	})
 
 	if err != nil {
+		db.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
-	return NewDatastore(db, NewQueriesForTable(opts.Table)), nil
+	err = opts.checkSchema(ctx, db)
+	if err == nil {
+		err = opts.checkFingerprint(ctx, db)
+	}
+	merge := false
+	if err == nil && opts.Merge {
+		merge, err = mergeSupported(ctx, db)
+	}
+	if err != nil {
+		db.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	d := NewDatastore(db, &queries{
+		tableName:       opts.Table,
+		keyColumn:       opts.KeyColumn,
+		dataColumn:      opts.DataColumn,
+		collation:       opts.KeyCollation,
+		skipEmptyValues: opts.SkipEmptyValues,
+		seq:             opts.Seq,
+		timestamps:      opts.Timestamps,
+		accessTimes:     opts.AccessTimes,
+		ttl:             opts.TTL,
+		merge:           merge,
+		checksums:       opts.Checksums,
+		skipIdentical:   opts.SkipIdenticalPuts,
+		textValues:      opts.TextValues,
+		escape:          opts.LikeEscape,
+		largeObjects:    opts.LargeObjects,
+	})
+	opts.configure(d)
+	d.connInfo = opts.postgresConnInfo()
+
+	if opts.ReplicaHost != "" {
+		replica, err := sql.Open("postgres", opts.dsn(opts.ReplicaHost, opts.ReplicaPort))
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		opts.configurePool(replica)
+		if err := pingContext(ctx, replica); err != nil {
+			replica.Close()
+			d.Close()
+			return nil, err
+		}
+		d.replica = replica
+	}
+	return d, nil
+}
+
+// mergeSupported reports whether the server has MERGE, added in postgres 15.
+func mergeSupported(ctx context.Context, db *sql.DB) (bool, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return false, err
+	}
+	return version >= 150000, nil
+}
+
+// checkPortable returns ErrUnsupported if any option shaping postgres SQL
+// is set, for backends whose Queries don't implement them.
+func (opts *Options) checkPortable(backend string) error {
+	if opts.Seq || opts.Timestamps || opts.TTL || opts.AccessTimes || opts.Merge || opts.Checksums || opts.LargeObjects || opts.Partitions > 0 || opts.TextValues ||
+		opts.ReplicaHost != "" || opts.KeyCollation != "" || opts.SkipIdenticalPuts || opts.SkipEmptyValues ||
+		opts.KeyColumn != "" || opts.DataColumn != "" || opts.MaxKeys > 0 ||
+		(opts.LikeEscape != 0 && opts.LikeEscape != '\\') {
+		return fmt.Errorf("%w: option not available for %s", ErrUnsupported, backend)
+	}
+	return nil
+}
+
+// configurePool applies the connection pool options that are set to db.
+func (opts *Options) configurePool(db *sql.DB) {
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	if opts.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	}
+}
+
+// configure applies the options that don't depend on the database to d.
+func (opts *Options) configure(d *Datastore) {
+	d.batchHooks = opts.BatchHooks
+	d.validate = opts.KeyValidator
+	if opts.MaxKeyLength > 0 {
+		d.validate = keyLengthValidator(opts.MaxKeyLength, opts.KeyValidator)
+	}
+	if opts.KeyColumn != "" {
+		d.conflictKey = conflictPattern(opts.keyColumnName())
+	}
+	d.queryBuffer = opts.QueryBufferSize
+	d.analyzeThreshold = opts.AnalyzeThreshold
+	d.txnRetries = opts.SerializationRetries
+	d.closeTimeout = opts.CloseTimeout
+	d.recorder = opts.Recorder
+	d.timings = opts.Timings
+	d.legacyPrefixes = opts.LegacyPrefixMatching
+	d.emptyCheckTTL = opts.EmptyCheckTTL
+	d.maxScanBytes = opts.MaxScanBytes
+	d.sizeFallback = opts.GetSizeFallback
+	if opts.IndexAdvisor {
+		d.advisor = newIndexAdvisor()
+	}
+	if opts.CoalesceWindow > 0 {
+		d.coalesce = newCoalescer(opts.CoalesceWindow, func(key string, value []byte) error {
+			return d.write(context.Background(), ds.RawKey(key), value, d.queries.Put())
+		}, d.logf)
+	}
+	if opts.WarnSeqScans {
+		d.seqScans = newSeqScanGuard()
+	}
+	d.logger = opts.Logger
+	d.maxKeys = opts.MaxKeys
+	d.evictBy = opts.EvictBy
+	if opts.MaxKeys > 0 {
+		interval := opts.ReapInterval
+		if interval <= 0 {
+			interval = defaultReapInterval
+		}
+		d.reaper = startReaper(d, interval)
+	}
+	if opts.NegativeCacheSize > 0 {
+		d.negCache = newNegativeCache(opts.NegativeCacheSize, opts.NegativeCacheTTL)
+	}
+	if opts.PrepareStatements {
+		d.stmts = newStmtCache(d.db)
+	}
+	if opts.CircuitBreakerThreshold > 0 {
+		d.breaker = newCircuitBreaker(opts.CircuitBreakerThreshold, opts.CircuitBreakerCooldown)
+	}
+}
+
+func (opts *Options) dsn(host, port string) string {
+	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=%s"
+	dsn := fmt.Sprintf(fmtstr, opts.Database, host, port, opts.User, opts.Password, opts.SSLMode)
+	for _, p := range []struct{ name, value string }{
+		{"sslrootcert", opts.SSLRootCert},
+		{"sslcert", opts.SSLCert},
+		{"sslkey", opts.SSLKey},
+	} {
+		if p.value != "" {
+			dsn += "&" + p.name + "=" + url.QueryEscape(p.value)
+		}
+	}
+	if params := opts.encodeParams(); params != "" {
+		dsn += "&" + params
+	}
+	return dsn
+}
+
+// encodeParams returns Params as an escaped query string, sorted by name.
+func (opts *Options) encodeParams() string {
+	values := url.Values{}
+	for name, value := range opts.Params {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// pingContext pings db, returning as soon as ctx is done. The driver does not
+// observe the context for the whole connection handshake, so the ping is left
+// to finish in the background in that case.
+func pingContext(ctx context.Context, db *sql.DB) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- db.PingContext(ctx)
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (opts *Options) setDefaults() {
@@ -93,11 +1078,31 @@ func (opts *Options) setDefaults() {
 		opts.Port = "5432"
 	}
 
+	if opts.ReplicaHost != "" && opts.ReplicaPort == "" {
+		opts.ReplicaPort = opts.Port
+	}
+
 	if opts.User == "" {
 		opts.User = "postgres"
 	}
 
+	if opts.SSLMode == "" {
+		opts.SSLMode = "disable"
+	}
+
 	if opts.Database == "" {
 		opts.Database = "datastore"
 	}
+
+	if opts.NegativeCacheSize > 0 && opts.NegativeCacheTTL == 0 {
+		opts.NegativeCacheTTL = time.Minute
+	}
+
+	if opts.CircuitBreakerThreshold > 0 && opts.CircuitBreakerCooldown == 0 {
+		opts.CircuitBreakerCooldown = 30 * time.Second
+	}
+
+	if opts.EmptyCheckTTL == 0 {
+		opts.EmptyCheckTTL = time.Second
+	}
 }
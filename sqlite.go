@@ -0,0 +1,203 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3" //sqlite driver
+)
+
+// sqliteQueries are the Queries for a SQLite table. SQLite has no array
+// parameters, so the statements taking a list of keys are unsupported.
+type sqliteQueries struct {
+	tableName string
+}
+
+// NewSQLiteQueriesForTable returns the Queries for a SQLite table. The
+// connection must have case-sensitive LIKE enabled, as CreateSQLite does,
+// for prefix queries to match keys exactly.
+func NewSQLiteQueriesForTable(tableName string) Queries {
+	return sqliteQueries{tableName: tableName}
+}
+
+func (q sqliteQueries) Delete() string {
+	return `DELETE FROM ` + q.table() + ` WHERE key = ?`
+}
+
+func (q sqliteQueries) Exists() string {
+	return `SELECT EXISTS(SELECT 1 FROM ` + q.table() + ` WHERE key = ?)`
+}
+
+func (q sqliteQueries) Get() string {
+	return `SELECT data FROM ` + q.table() + ` WHERE key = ?`
+}
+
+func (q sqliteQueries) Put() string {
+	return `INSERT INTO ` + q.table() + ` (key, data) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET data = excluded.data`
+}
+
+func (q sqliteQueries) Query() string {
+	return `SELECT key, data FROM ` + q.table()
+}
+
+func (q sqliteQueries) QueryKeysOnly() string {
+	return `SELECT key FROM ` + q.table()
+}
+
+func (q sqliteQueries) QuerySizes() string {
+	return `SELECT key, length(data) FROM ` + q.table()
+}
+
+func (q sqliteQueries) TotalSize() string {
+	return `SELECT coalesce(sum(length(data)), 0) FROM ` + q.table()
+}
+
+func (q sqliteQueries) Empty() string {
+	return `SELECT NOT EXISTS (SELECT 1 FROM ` + q.table() + `)`
+}
+
+func (q sqliteQueries) Prefix() string {
+	return ` WHERE key LIKE ? ESCAPE '\' ORDER BY key`
+}
+
+func (q sqliteQueries) PrefixDescending() string {
+	return ` WHERE key LIKE ? ESCAPE '\' ORDER BY key DESC`
+}
+
+func (q sqliteQueries) OrderByKey() string {
+	return ` ORDER BY key`
+}
+
+func (q sqliteQueries) OrderByKeyDescending() string {
+	return ` ORDER BY key DESC`
+}
+
+func (q sqliteQueries) PrefixByKeyLength() string {
+	return ` WHERE key LIKE ? ESCAPE '\' ORDER BY length(key), key`
+}
+
+func (q sqliteQueries) OrderByKeyLength() string {
+	return ` ORDER BY length(key), key`
+}
+
+func (q sqliteQueries) Limit() string {
+	return ` LIMIT %d`
+}
+
+func (q sqliteQueries) Offset() string {
+	return ` OFFSET %d`
+}
+
+// NoLimit is SQLite's form of an unbounded LIMIT.
+func (q sqliteQueries) NoLimit() string {
+	return ` LIMIT -1`
+}
+
+func (q sqliteQueries) GetSize() string {
+	return `SELECT length(data) FROM ` + q.table() + ` WHERE key = ?`
+}
+
+func (q sqliteQueries) ExistingKeys() string {
+	return ""
+}
+
+// Compact rebuilds the whole database file, the only way SQLite returns
+// free pages to the filesystem.
+func (q sqliteQueries) Compact() string {
+	return `VACUUM`
+}
+
+func (q sqliteQueries) Reindex() string {
+	return `REINDEX ` + q.table()
+}
+
+// Vacuum is Compact: SQLite reuses free pages without being asked.
+func (q sqliteQueries) Vacuum() string {
+	return `VACUUM`
+}
+
+func (q sqliteQueries) Analyze() string {
+	return `ANALYZE ` + q.table()
+}
+
+func (q sqliteQueries) DeletePrefix() string {
+	return `DELETE FROM ` + q.table() + ` WHERE key LIKE ? ESCAPE '\'`
+}
+
+func (q sqliteQueries) DeleteMany() string {
+	return ""
+}
+
+func (q sqliteQueries) SizesMany() string {
+	return ""
+}
+
+func (q sqliteQueries) GetMany() string {
+	return ""
+}
+
+func (q sqliteQueries) LikeEscape() rune {
+	return '\\'
+}
+
+// QuoteIdent quotes a single identifier, which SQLite does like postgres.
+func (q sqliteQueries) QuoteIdent(name string) string {
+	return pgQuoteIdent(name)
+}
+
+func (q sqliteQueries) table() string {
+	return quoteQualified(q.QuoteIdent, q.tableName)
+}
+
+func (opts *Options) sqliteCreateTableSQL() string {
+	table := sqliteQueries{tableName: opts.Table}.table()
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (key TEXT NOT NULL PRIMARY KEY, data BLOB NOT NULL)`
+}
+
+// sqliteDSN returns the data source name for the database file at path. The
+// database is opened in WAL mode with a busy timeout, so the pool's
+// connections can read while one writes, and LIKE is made case-sensitive.
+func sqliteDSN(path string) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", "5000")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_cslike", "true")
+	return "file:" + path + "?" + params.Encode()
+}
+
+// CreateSQLite returns a datastore backed by the SQLite database file at
+// path, creating the file and its table if needed. Only Table, the pool
+// settings and the options that don't shape SQL apply; connection settings
+// are ignored, and the options shaping postgres SQL return ErrUnsupported if
+// set.
+func (opts *Options) CreateSQLite(path string) (*Datastore, error) {
+	return opts.CreateSQLiteContext(context.Background(), path)
+}
+
+// CreateSQLiteContext is like CreateSQLite, giving up when ctx is done.
+func (opts *Options) CreateSQLiteContext(ctx context.Context, path string) (*Datastore, error) {
+	if err := opts.checkPortable("SQLite"); err != nil {
+		return nil, err
+	}
+	opts.setDefaults()
+
+	db, err := sql.Open("sqlite3", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	opts.configurePool(db)
+
+	if _, err := db.ExecContext(ctx, opts.sqliteCreateTableSQL()); err != nil {
+		db.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	d := NewDatastore(db, sqliteQueries{tableName: opts.Table})
+	opts.configure(d)
+	d.connInfo = sqliteDSN(path)
+	return d, nil
+}
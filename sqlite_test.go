@@ -0,0 +1,467 @@
+package sqlds
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func newSQLiteDS(t *testing.T) (*Datastore, func()) {
+	dir, err := ioutil.TempDir("", "sqlds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	d, err := opts.CreateSQLite(filepath.Join(dir, "datastore.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	key := ds.NewKey("/a/b")
+	if err := d.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(key); err != nil || string(v) != "value" {
+		t.Fatalf("expected value, got %q, %v", v, err)
+	}
+	if has, err := d.Has(key); err != nil || !has {
+		t.Fatalf("expected the key to exist, got %v, %v", has, err)
+	}
+	if size, err := d.GetSize(key); err != nil || size != 5 {
+		t.Fatalf("expected size 5, got %d, %v", size, err)
+	}
+
+	if err := d.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(key); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := d.Delete(key); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound deleting a missing key, got %v", err)
+	}
+}
+
+func TestSQLitePutOverwrites(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	key := ds.NewKey("/a")
+	if err := d.Put(key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(key, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("expected the second value, got %q, %v", v, err)
+	}
+}
+
+func TestSQLiteEmptyValue(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	key := ds.NewKey("/empty")
+	if err := d.Put(key, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(key); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("expected an empty value, got %#v, %v", v, err)
+	}
+	if size, err := d.GetSize(key); err != nil || size != 0 {
+		t.Fatalf("expected size 0, got %d, %v", size, err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/batched"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(ds.NewKey("/batched")); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("expected an empty value, got %#v, %v", v, err)
+	}
+}
+
+func TestSQLiteDiskUsage(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	if n, err := ds.DiskUsage(d); err != nil || n != 0 {
+		t.Fatalf("expected no usage while empty, got %d, %v", n, err)
+	}
+	for k, v := range map[string]string{"/a": "1", "/b": "22", "/c": "333"} {
+		if err := d.Put(ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := ds.DiskUsage(d); err != nil || n != 6 {
+		t.Fatalf("expected the values' 6 bytes, got %d, %v", n, err)
+	}
+}
+
+func TestSQLiteSpillingBatch(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	const n, flushEvery = 1050, 100
+	b, err := d.SpillingBatch(context.Background(), SpillOptions{FlushEvery: flushEvery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := b.Put(ds.NewKey(fmt.Sprintf("/k/%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		if len(b.pending) >= flushEvery {
+			t.Fatalf("%d operations held after %d puts", len(b.pending), i+1)
+		}
+	}
+	if b.Flushed() != 1000 {
+		t.Fatalf("expected 1000 operations flushed before Commit, got %d", b.Flushed())
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		v, err := d.Get(ds.NewKey(fmt.Sprintf("/k/%04d", i)))
+		if err != nil || string(v) != fmt.Sprint(i) {
+			t.Fatalf("/k/%04d: got %q, %v", i, v, err)
+		}
+	}
+}
+
+func TestSQLiteSpillingBatchJournal(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "sqlds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := SpillOptions{FlushEvery: 10, Journal: filepath.Join(dir, "journal")}
+	ctx := context.Background()
+
+	b, err := d.SpillingBatch(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15; i++ {
+		if err := b.Put(ds.NewKey(fmt.Sprintf("/k/%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stop without committing, as a crash would.
+	b.journal.Close()
+	if has, err := d.Has(ds.NewKey("/k/14")); err != nil || has {
+		t.Fatalf("expected the unflushed put to be pending, got %v, %v", has, err)
+	}
+
+	b, err = d.SpillingBatch(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Flushed() != 5 {
+		t.Fatalf("expected the 5 journaled puts to be recovered, got %d", b.Flushed())
+	}
+	for i := 0; i < 15; i++ {
+		if has, err := d.Has(ds.NewKey(fmt.Sprintf("/k/%02d", i))); err != nil || !has {
+			t.Fatalf("/k/%02d: expected it written, got %v, %v", i, has, err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(opts.Journal); !os.IsNotExist(err) {
+		t.Fatalf("expected Commit to remove the journal, got %v", err)
+	}
+}
+
+func TestSQLiteQuery(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a/1", "/a/2", "/a/3", "/A/1", "/a%/1", "/ab/1"} {
+		if err := b.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		q      dsq.Query
+		expect []string
+	}{
+		{dsq.Query{Prefix: "/a"}, []string{"/a/1", "/a/2", "/a/3"}},
+		{dsq.Query{Prefix: "/a", Offset: 1}, []string{"/a/2", "/a/3"}},
+		{dsq.Query{Prefix: "/a", Limit: 1, Offset: 1}, []string{"/a/2"}},
+		{dsq.Query{Prefix: "/a%"}, []string{"/a%/1"}},
+		{dsq.Query{Prefix: "/A"}, []string{"/A/1"}},
+		{dsq.Query{Limit: 2}, []string{"/A/1", "/a%/1"}},
+		{dsq.Query{Offset: 4}, []string{"/a/3", "/ab/1"}},
+		{dsq.Query{Limit: 2, Offset: 2}, []string{"/a/1", "/a/2"}},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}, Limit: 2}, []string{"/a/1", "/a/2"}},
+		{dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/a%/1"}}}, []string{"/a%/1"}},
+		{dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 2}, []string{"/a/3", "/a/2"}},
+		{dsq.Query{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 2, Offset: 1}, []string{"/a/3", "/a/2"}},
+	} {
+		rs, err := d.Query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		if len(got) != len(c.expect) {
+			t.Errorf("%v: expected %v, got %v", c.q, c.expect, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.expect[i] {
+				t.Errorf("%v: expected %v, got %v", c.q, c.expect, got)
+				break
+			}
+		}
+	}
+}
+
+func TestSQLiteOrderByKeyLength(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+	keys := []string{"/bbb", "/a", "/cc", "/\u00e9", "/x/yyyy", "/ab", "/p/ccc", "/p/a", "/p/bb"}
+	for _, k := range keys {
+		if err := d.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byLength := []dsq.Order{OrderByKeyLength{}}
+	for _, c := range []struct {
+		q      dsq.Query
+		expect string
+	}{
+		// Lengths count characters, not bytes, and ties are broken by key.
+		{dsq.Query{Orders: byLength}, "/a,/\u00e9,/ab,/cc,/bbb,/p/a,/p/bb,/p/ccc,/x/yyyy"},
+		{dsq.Query{Orders: byLength, Limit: 3, Offset: 1}, "/\u00e9,/ab,/cc"},
+		{dsq.Query{Prefix: "/p", Orders: byLength}, "/p/a,/p/bb,/p/ccc"},
+		// With another order, it is applied in Go like any other.
+		{dsq.Query{Prefix: "/p", Orders: []dsq.Order{OrderByKeyLength{}, dsq.OrderByKeyDescending{}}}, "/p/a,/p/bb,/p/ccc"},
+	} {
+		rs, err := d.Query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		if strings.Join(got, ",") != c.expect {
+			t.Errorf("%v: expected %s, got %v", c.q, c.expect, got)
+		}
+
+		// Sorting in Go gives the same order.
+		dsq.Sort(c.q.Orders, entries)
+		for i, e := range entries {
+			if e.Key != got[i] {
+				t.Errorf("%v: sorting in Go gave %v", c.q, entries)
+				break
+			}
+		}
+	}
+}
+
+func TestSQLiteDeletePrefix(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		d, done := newSQLiteDS(t)
+		d.legacyPrefixes = legacy
+
+		for _, k := range []string{"/foo/a", "/foo/b/c", "/foobar", "/bar"} {
+			if err := d.Put(ds.NewKey(k), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err := d.DeletePrefix(context.Background(), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only legacy matching reaches across the segment boundary.
+		want := int64(2)
+		if legacy {
+			want = 3
+		}
+		if n != want {
+			t.Errorf("legacy %v: expected %d keys deleted, got %d", legacy, want, n)
+		}
+		if has, err := d.Has(ds.NewKey("/foobar")); err != nil || has == legacy {
+			t.Errorf("legacy %v: unexpected /foobar presence %v, %v", legacy, has, err)
+		}
+		if has, err := d.Has(ds.NewKey("/bar")); err != nil || !has {
+			t.Errorf("legacy %v: expected /bar to survive, got %v, %v", legacy, has, err)
+		}
+		done()
+	}
+}
+
+func TestSQLiteMergeTrailingSlashes(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	// ds.Key can't hold a trailing slash, so the rows are written as a
+	// legacy writer would have.
+	for k, v := range map[string]string{
+		"/foo":   "clean",
+		"/foo/":  "slashed",
+		"/bar//": "only slashed",
+		"/baz":   "untouched",
+		"/a/b/":  "nested",
+	} {
+		if _, err := d.DB().Exec(d.queries.Put(), k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := d.MergeTrailingSlashes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 rows merged, got %d", n)
+	}
+
+	res, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		got[e.Key] = string(e.Value)
+	}
+	// The key without the slash wins over its slashed duplicate.
+	want := map[string]string{"/foo": "clean", "/bar": "only slashed", "/baz": "untouched", "/a/b": "nested"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected rows after merging:\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestSQLiteCopy(t *testing.T) {
+	src, doneSrc := newSQLiteDS(t)
+	defer doneSrc()
+	for _, k := range []string{"/a/1", "/a/2", "/a/3", "/b/1"} {
+		if err := src.Put(ds.NewKey(k), []byte("new"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		policy  ConflictPolicy
+		written int64
+		err     error
+		expect  map[string]string
+	}{
+		{ConflictSkip, 2, nil, map[string]string{"/a/1": "old", "/a/2": "new/a/2", "/a/3": "new/a/3"}},
+		{ConflictOverwrite, 3, nil, map[string]string{"/a/1": "new/a/1", "/a/2": "new/a/2", "/a/3": "new/a/3"}},
+		{ConflictError, 0, ErrKeyExists, map[string]string{"/a/1": "old"}},
+	}
+	for _, c := range cases {
+		dst, doneDst := newSQLiteDS(t)
+		if err := dst.Put(ds.NewKey("/a/1"), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := src.Copy(context.Background(), dst, CopyOptions{Prefix: "/a", OnConflict: c.policy, BatchSize: 2})
+		if err != c.err {
+			t.Errorf("policy %d: expected error %v, got %v", c.policy, c.err, err)
+		}
+		if n != c.written {
+			t.Errorf("policy %d: expected %d keys written, got %d", c.policy, c.written, n)
+		}
+
+		got := map[string]string{}
+		rs, err := dst.Query(dsq.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := rs.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			got[e.Key] = string(e.Value)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expect) {
+			t.Errorf("policy %d: expected %v, got %v", c.policy, c.expect, got)
+		}
+		doneDst()
+	}
+}
+
+func TestSQLiteKeysOnly(t *testing.T) {
+	d, done := newSQLiteDS(t)
+	defer done()
+
+	for _, k := range []string{"/a/1", "/a/2"} {
+		if err := d.Put(ds.NewKey(k), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := d.Query(dsq.Query{Prefix: "/a", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Value != nil || e.Size != -1 {
+			t.Errorf("%s: expected no value and an unknown size, got %q, %d", e.Key, e.Value, e.Size)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package sqlds
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// stmtCache holds prepared statements for the single-key operations, so
+// each is parsed and planned once per connection rather than per call.
+type stmtCache struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	stmts  map[string]*sql.Stmt
+	hits   uint64
+	misses uint64
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepare returns the cached statement for query, preparing it on first use.
+func (c *stmtCache) prepare(query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		atomic.AddUint64(&c.hits, 1)
+		return stmt, nil
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for query, stmt := range c.stmts {
+		if cerr := stmt.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.stmts, query)
+	}
+	return err
+}
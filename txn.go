@@ -0,0 +1,168 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// txn is a ds.Txn backed by a single SQL transaction. Reads, including
+// Query, see the transaction's own uncommitted writes.
+type txn struct {
+	d       *Datastore
+	tx      *sql.Tx
+	putKeys []string
+	// recorded holds the writes to record once the transaction commits.
+	recorded []Op
+	// taken holds the values the coalescer held for the keys written, to
+	// hold again should the transaction roll back.
+	taken map[string][]byte
+}
+
+// NewTransaction begins a SQL transaction. Writes made through it only
+// become visible to other callers once Commit returns. Values held by the
+// coalescer are written first, so the transaction sees them.
+func (d *Datastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	if err := d.coalesce.flush(); err != nil {
+		return nil, err
+	}
+	tx, err := d.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	return &txn{d: d, tx: tx}, nil
+}
+
+func (t *txn) Get(key ds.Key) ([]byte, error) {
+	row := t.tx.QueryRow(t.d.queries.Get(), key.String())
+	var out []byte
+
+	switch err := row.Scan(&out); err {
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	case nil:
+		return out, nil
+	default:
+		return nil, keyError("get", key.String(), err)
+	}
+}
+
+func (t *txn) Has(key ds.Key) (exists bool, err error) {
+	row := t.tx.QueryRow(t.d.queries.Exists(), key.String())
+
+	switch err := row.Scan(&exists); err {
+	case sql.ErrNoRows, nil:
+		return exists, nil
+	default:
+		return exists, keyError("has", key.String(), err)
+	}
+}
+
+func (t *txn) GetSize(key ds.Key) (int, error) {
+	row := t.tx.QueryRow(t.d.queries.GetSize(), key.String())
+	var size int
+
+	switch err := row.Scan(&size); err {
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		return size, nil
+	default:
+		return 0, keyError("get size", key.String(), err)
+	}
+}
+
+// Query runs q inside the transaction.
+func (t *txn) Query(q dsq.Query) (dsq.Results, error) {
+	return t.d.query(context.Background(), t.tx, q, nil)
+}
+
+func (t *txn) Put(key ds.Key, value []byte) error {
+	if value == nil {
+		return ErrInvalidType
+	}
+
+	if err := t.d.validateKey(key); err != nil {
+		return err
+	}
+
+	t.take(key.String())
+	if _, err := t.tx.Exec(t.d.queries.Put(), key.String(), value); err != nil {
+		return keyError("put", key.String(), err)
+	}
+
+	if t.d.negCache != nil {
+		t.putKeys = append(t.putKeys, key.String())
+	}
+	if t.d.recorder != nil {
+		t.recorded = append(t.recorded, Op{Type: OpPut, Key: key.String(), ValueLen: len(value), Value: value})
+	}
+	return nil
+}
+
+func (t *txn) Delete(key ds.Key) error {
+	if err := t.d.validateKey(key); err != nil {
+		return err
+	}
+
+	t.take(key.String())
+	if _, err := t.tx.Exec(t.d.queries.Delete(), key.String()); err != nil {
+		return keyError("delete", key.String(), err)
+	}
+
+	if t.d.recorder != nil {
+		t.recorded = append(t.recorded, Op{Type: OpDelete, Key: key.String()})
+	}
+	return nil
+}
+
+// take takes the value the coalescer holds for key, put since the
+// transaction began, so that it can't land after the commit.
+func (t *txn) take(key string) {
+	c := t.d.coalesce
+	if c == nil {
+		return
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if v, ok := c.take(key); ok {
+		if t.taken == nil {
+			t.taken = make(map[string][]byte)
+		}
+		t.taken[key] = v
+	}
+}
+
+// restore holds the taken values again, the transaction's writes having
+// been rolled back.
+func (t *txn) restore() {
+	if len(t.taken) > 0 {
+		t.d.coalesce.hold(t.taken)
+		t.taken = nil
+	}
+}
+
+func (t *txn) Commit() error {
+	if err := t.tx.Commit(); err != nil {
+		t.restore()
+		return keysError("commit", "transaction", err)
+	}
+	t.taken = nil
+
+	for _, k := range t.putKeys {
+		t.d.negCache.remove(k)
+	}
+	for _, op := range t.recorded {
+		t.d.recorder(op)
+	}
+	return nil
+}
+
+// Discard rolls the transaction back.
+func (t *txn) Discard() {
+	t.tx.Rollback()
+	t.restore()
+}
@@ -0,0 +1,84 @@
+package sqlds
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestTxnQuerySeesOwnWrites(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	if err := d.Put(ds.NewKey("/t/committed"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"/t/a", "/t/b"} {
+		if err := txn.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := txn.Query(dsq.Query{Prefix: "/t/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/t/a", "/t/b", "/t/committed"}, rs)
+
+	// Outside the transaction the writes are not visible yet.
+	rs, err = d.Query(dsq.Query{Prefix: "/t/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/t/committed"}, rs)
+
+	txn.Discard()
+
+	for _, k := range []string{"/t/a", "/t/b"} {
+		has, err := d.Has(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			t.Errorf("%s should be absent after discarding the transaction", k)
+		}
+	}
+}
+
+func TestTxnCommit(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ds.NewKey("/t/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	val, err := txn.Get(ds.NewKey("/t/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "a" {
+		t.Fatalf("got wrong value: %s", val)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err = d.Get(ds.NewKey("/t/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "a" {
+		t.Fatalf("got wrong value: %s", val)
+	}
+}
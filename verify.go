@@ -0,0 +1,78 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+)
+
+// ErrChecksumMismatch is reported by Verify for entries whose value no longer
+// matches the checksum stored when it was written.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyPageSize is the number of entries Verify reads per statement.
+const verifyPageSize = 1000
+
+// VerifyQueries is implemented by Queries for tables that store a checksum
+// of each value.
+type VerifyQueries interface {
+	// VerifyPage selects key, data and the SHA-256 checksum of up to the
+	// second argument entries whose keys sort after the first, in key
+	// order. It returns an empty string when the table has no checksums.
+	VerifyPage() string
+}
+
+// Verify reads every entry with a key after fromKey, in key order, and
+// calls report with ErrChecksumMismatch for each whose value doesn't match
+// its stored checksum. It returns the last key verified, which can be
+// passed as fromKey to resume an audit that was interrupted, including by
+// cancelling ctx; start from "". Entries are read a page at a time, each
+// page starting after the last key of the one before, so resuming never
+// rereads what was verified. It requires the table to have been created
+// with checksums enabled.
+func (d *Datastore) Verify(ctx context.Context, fromKey string, report func(key string, err error)) (string, error) {
+	vq, ok := d.queries.(VerifyQueries)
+	if !ok || vq.VerifyPage() == "" {
+		return fromKey, ErrUnsupported
+	}
+
+	last := fromKey
+	for {
+		n, err := d.verifyPage(ctx, vq.VerifyPage(), &last, report)
+		if err != nil {
+			return last, err
+		}
+		if n < verifyPageSize {
+			return last, nil
+		}
+	}
+}
+
+// verifyPage verifies the page of entries after *lastKey, advancing it past
+// each entry checked, and returns how many entries the page held.
+func (d *Datastore) verifyPage(ctx context.Context, stmt string, lastKey *string, report func(string, error)) (int, error) {
+	waits := d.db.Stats().WaitCount
+	rows, err := d.db.QueryContext(ctx, stmt, *lastKey, verifyPageSize)
+	if err != nil {
+		return 0, d.poolError(ctxError(ctx, err), waits)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var key string
+		var data sql.RawBytes
+		var sum []byte
+		if err := rows.Scan(&key, &data, &sum); err != nil {
+			return n, err
+		}
+		if got := sha256.Sum256(data); !bytes.Equal(got[:], sum) {
+			report(key, ErrChecksumMismatch)
+		}
+		*lastKey = key
+		n++
+	}
+	return n, ctxError(ctx, rows.Err())
+}